@@ -0,0 +1,204 @@
+package main
+
+import (
+  "os"
+  "sync"
+  "json"
+  "strings"
+  "io/ioutil"
+)
+
+/* Per user access rules, given with -acl-config on top of -sasl-pwdb. The
+   configuration is a json file such as
+
+   {
+     "users": {
+       "web":   {"read": ["web:", "shared:"], "write": ["web:"]},
+       "batch": {"read": [""], "write": ["batch:"]},
+       "ops":   {"read": [""], "write": [""], "admin": true}
+     }
+   }
+
+   A user may read or write the keys starting with one of its prefixes, the
+   empty prefix matching every key. Commands returning a value read their
+   keys and commands changing one write them, incr, decr, gat and ma do both.
+   Admin users may run flush_all, stats with arguments, shutdown and
+   replication promote. Users not listed are denied everything. The file is
+   read again on SIGHUP */
+
+type aclConfig struct {
+  Users map[string]struct {
+    Read  []string
+    Write []string
+    Admin bool
+  }
+}
+
+type ACL struct {
+  read  []string
+  write []string
+  admin bool
+}
+
+/* the rules of users not listed in the configuration */
+var noAccess = &ACL{}
+
+type ACLFile struct {
+  path  string
+  lock  sync.RWMutex
+  users map[string]*ACL
+}
+
+/* set when access rules are enforced, nil otherwise */
+var acls *ACLFile
+
+func newACLFile(path string) (*ACLFile, os.Error) {
+  self := &ACLFile{path: path}
+  if err := self.Reload(); err != nil {
+    return nil, err
+  }
+  return self, nil
+}
+
+func (self *ACLFile) Reload() os.Error {
+  data, err := ioutil.ReadFile(self.path)
+  if err != nil {
+    return err
+  }
+  var config aclConfig
+  if err := json.Unmarshal(data, &config); err != nil {
+    return err
+  }
+  users := make(map[string]*ACL)
+  for user, rules := range config.Users {
+    users[user] = &ACL{rules.Read, rules.Write, rules.Admin}
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.users = users
+  return nil
+}
+
+func (self *ACLFile) reloadOrLog() {
+  if err := self.Reload(); err != nil {
+    logger.Printf("Unable to reload the access rules, keeping the previous ones: %s", err)
+  } else {
+    logger.Println("Reloaded the access rules")
+  }
+}
+
+func (self *ACLFile) lookup(user string) *ACL {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  if acl, present := self.users[user]; present {
+    return acl
+  }
+  return noAccess
+}
+
+func matchesPrefix(prefixes []string, key string) bool {
+  for _, prefix := range prefixes {
+    if strings.HasPrefix(key, prefix) {
+      return true
+    }
+  }
+  return false
+}
+
+func (self *ACL) mayRead(keys []string) bool {
+  for _, key := range keys {
+    if !matchesPrefix(self.read, key) {
+      return false
+    }
+  }
+  return true
+}
+
+func (self *ACL) mayWrite(keys []string) bool {
+  for _, key := range keys {
+    if !matchesPrefix(self.write, key) {
+      return false
+    }
+  }
+  return true
+}
+
+/* the rules of the session user, nil when every command is allowed */
+func (s *Session) acl() *ACL {
+  if acls == nil {
+    return nil
+  }
+  return acls.lookup(s.user)
+}
+
+/* these tell the client when access is denied, as writable does */
+
+func (s *Session) mayRead(keys ...string) bool {
+  if acl := s.acl(); acl != nil && !acl.mayRead(keys) {
+    return Error(s, ClientError, "access denied")
+  }
+  return true
+}
+
+func (s *Session) mayWrite(keys ...string) bool {
+  if acl := s.acl(); acl != nil && !acl.mayWrite(keys) {
+    return Error(s, ClientError, "access denied")
+  }
+  return true
+}
+
+func (s *Session) mayReadWrite(keys ...string) bool {
+  if acl := s.acl(); acl != nil && !(acl.mayRead(keys) && acl.mayWrite(keys)) {
+    return Error(s, ClientError, "access denied")
+  }
+  return true
+}
+
+func (s *Session) mayAdminister() bool {
+  if acl := s.acl(); acl != nil && !acl.admin {
+    return Error(s, ClientError, "access denied")
+  }
+  return true
+}
+
+/* whether the session may run a binary request */
+func (s *Session) binaryAllowed(req *BinaryRequest) bool {
+  acl := s.acl()
+  if acl == nil {
+    return true
+  }
+  keys := []string{req.key}
+  switch req.opcode {
+  case opGet, opGetq, opGetk, opGetkq:
+    return acl.mayRead(keys)
+  case opIncr, opDecr, opGat, opGatq:
+    return acl.mayRead(keys) && acl.mayWrite(keys)
+  case opFlush:
+    return acl.admin
+  case opStat:
+    return req.key == "" || acl.admin
+  }
+  return !binaryWrites[req.opcode] || acl.mayWrite(keys)
+}
+
+/* gets read their keys, gats also write them */
+func (self *RetrievalCommand) allowed() bool {
+  if strings.HasPrefix(self.command, "gat") {
+    return self.session.mayReadWrite(self.keys...)
+  }
+  return self.session.mayRead(self.keys...)
+}
+
+/* mg reads, touching or creating the item with T or N also writes. ms and
+   md write, ma does both */
+func (self *MetaCommand) allowed() bool {
+  switch {
+  case self.command == "mn":
+    return true
+  case self.command == "ma" || self.writes():
+    return self.session.mayReadWrite(self.key)
+  case self.command == "ms" || self.command == "md":
+    return self.session.mayWrite(self.key)
+  }
+  return self.session.mayRead(self.key)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+)
+
+func TestACLPrefixes(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test_acl.json"
+  defer os.Remove(path)
+  ioutil.WriteFile(path, []byte(`{
+    "users": {
+      "web": {"read": ["web:", "shared:"], "write": ["web:"]},
+      "ops": {"read": [""], "write": [""], "admin": true}
+    }
+  }`), 0644)
+
+  file, err := newACLFile(path)
+  assertEquals(t, err == nil, true, "access rules not loaded")
+
+  web := file.lookup("web")
+  assertEquals(t, web.mayRead([]string{"web:1", "shared:1"}), true, "readable keys denied")
+  assertEquals(t, web.mayRead([]string{"web:1", "batch:1"}), false, "multi-get with a foreign key allowed")
+  assertEquals(t, web.mayWrite([]string{"shared:1"}), false, "read only prefix writable")
+  assertEquals(t, web.admin, false, "admin granted")
+
+  ops := file.lookup("ops")
+  assertEquals(t, ops.mayWrite([]string{"anything"}), true, "empty prefix doesn't match every key")
+  assertEquals(t, ops.admin, true, "admin not granted")
+
+  nobody := file.lookup("nobody")
+  assertEquals(t, nobody.mayRead([]string{"web:1"}), false, "unlisted user allowed to read")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "sync"
+  "strings"
+  "io/ioutil"
+  "crypto/subtle"
+)
+
+/* SASL PLAIN authentication. With -sasl-pwdb every connection has to
+   authenticate before running any other command, binary clients through
+   the SASL opcodes and text clients with the memcached 1.5 form
+
+   set <any key> <flags> <exptime> <bytes>\r\n
+   <username> <password>\r\n
+
+   The password file has one username:password per line, lines starting with
+   # are ignored. It is read again on SIGHUP */
+
+const saslMechanisms = "PLAIN"
+
+type PasswordFile struct {
+  path  string
+  lock  sync.RWMutex
+  users map[string]string
+}
+
+/* set when authentication is required, nil otherwise */
+var passwords *PasswordFile
+
+func newPasswordFile(path string) (*PasswordFile, os.Error) {
+  self := &PasswordFile{path: path}
+  if err := self.Reload(); err != nil {
+    return nil, err
+  }
+  return self, nil
+}
+
+func (self *PasswordFile) Reload() os.Error {
+  data, err := ioutil.ReadFile(self.path)
+  if err != nil {
+    return err
+  }
+  users := make(map[string]string)
+  for number, line := range strings.Split(string(data), "\n") {
+    if line = strings.TrimRight(line, "\r"); line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    separator := strings.Index(line, ":")
+    if separator <= 0 {
+      return os.NewError(fmt.Sprintf("Bad password file line %d", number + 1))
+    }
+    users[line[:separator]] = line[separator+1:]
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.users = users
+  return nil
+}
+
+func (self *PasswordFile) reloadOrLog() {
+  if err := self.Reload(); err != nil {
+    logger.Printf("Unable to reload the password file, keeping the previous one: %s", err)
+  } else {
+    logger.Println("Reloaded the password file")
+  }
+}
+
+/* whether password is the one of user */
+func (self *PasswordFile) verify(user string, password string) bool {
+  self.lock.RLock()
+  expected, present := self.users[user]
+  self.lock.RUnlock()
+  // compare anyway so unknown users take as long as bad passwords
+  matches := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+  return present && matches
+}
+
+/* the user of a SASL PLAIN message, [authzid] \0 authcid \0 passwd, empty
+   if it doesn't authenticate. Authorizing as another user is not supported */
+func (self *PasswordFile) plain(message []byte) string {
+  fields := strings.Split(string(message), "\x00")
+  if len(fields) != 3 || fields[1] == "" || (fields[0] != "" && fields[0] != fields[1]) {
+    return ""
+  }
+  if self.verify(fields[1], fields[2]) {
+    return fields[1]
+  }
+  return ""
+}
+
+/* whether the session may run commands */
+func (s *Session) authenticated() bool {
+  return passwords == nil || s.user != ""
+}
+
+/* the only command accepted from unauthenticated text clients, a set
+   carrying the credentials as its data */
+func (s *Session) textAuthentication(line []string) {
+  if line[0] != "set" {
+    Error(s, ClientError, "unauthenticated")
+    return
+  }
+  cmd := &StorageCommand{session: s}
+  if !cmd.parse(line) {
+    return
+  }
+  credentials := strings.Fields(string(cmd.data))
+  if len(credentials) == 2 && passwords.verify(credentials[0], credentials[1]) {
+    s.user = credentials[0]
+    s.writer.Write([]byte("STORED\r\n"))
+  } else {
+    Error(s, ClientError, "authentication failure")
+  }
+}
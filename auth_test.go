@@ -0,0 +1,26 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+)
+
+func TestPasswordFile(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test_passwords"
+  defer os.Remove(path)
+  ioutil.WriteFile(path, []byte("# services\nweb:secret\r\nbatch:pass:word\n\n"), 0600)
+
+  file, err := newPasswordFile(path)
+  assertEquals(t, err == nil, true, "password file not loaded")
+  assertEquals(t, file.verify("web", "secret"), true, "valid password rejected")
+  assertEquals(t, file.verify("batch", "pass:word"), true, "password with colons rejected")
+  assertEquals(t, file.verify("web", "wrong"), false, "wrong password accepted")
+  assertEquals(t, file.verify("nobody", ""), false, "unknown user accepted")
+
+  assertEquals(t, file.plain([]byte("\x00web\x00secret")), "web", "PLAIN message rejected")
+  assertEquals(t, file.plain([]byte("web\x00web\x00secret")), "web", "PLAIN with own authzid rejected")
+  assertEquals(t, file.plain([]byte("batch\x00web\x00secret")), "", "PLAIN authorizing as another user accepted")
+  assertEquals(t, file.plain([]byte("web\x00secret")), "", "malformed PLAIN message accepted")
+}
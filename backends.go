@@ -0,0 +1,102 @@
+package main
+
+import (
+  "sort"
+)
+
+/* the storage a backend builds, along with the parts of it the server needs
+   to reach. Parts a backend doesn't use are left nil */
+type StorageStack struct {
+  storage        CacheStorage
+  hashing        *HashingStorage
+  generational   *GenerationalStorage
+  updatesChannel chan UpdateMessage
+  partitions     []CacheStorage
+}
+
+/* a stack around the, possibly partitioned, base storage */
+func newStorageStack(storage CacheStorage) *StorageStack {
+  stack := &StorageStack{storage: storage, partitions: []CacheStorage{storage}}
+  if hashing, ok := storage.(*HashingStorage); ok {
+    stack.hashing = hashing
+    stack.partitions = hashing.storageBuckets
+  }
+  return stack
+}
+
+type BackendOptions struct {
+  partitions       int
+  memory           *MemoryLimit
+  slabs            *SlabAllocator
+  expiringInterval int64
+}
+
+/* a named storage implementation selectable with -storage */
+type StorageBackend struct {
+  description string
+  build       func(options *BackendOptions) *StorageStack
+  adapted     bool // a legacy Storage behind a StorageAdapter
+}
+
+var storageBackends = map[string]*StorageBackend{
+  "generational": &StorageBackend{
+    "map storage with expirations collected by generations",
+    buildGenerationalBackend,
+    false,
+  },
+  "map": &StorageBackend{
+    "map storage, entries only expire when accessed",
+    func(options *BackendOptions) *StorageStack {
+      return newStorageStack(partitioned(options, mapCacheStorageFactory(options)))
+    },
+    false,
+  },
+  "heap": &StorageBackend{
+    "legacy map storage with expirations collected from a heap",
+    func(options *BackendOptions) *StorageStack {
+      factory := func() CacheStorage { return newStorageAdapter(newNotifyStorage(options.expiringInterval)) }
+      return newStorageStack(partitioned(options, factory))
+    },
+    true,
+  },
+  "legacy-map": &StorageBackend{
+    "legacy map storage, entries only expire when accessed",
+    func(options *BackendOptions) *StorageStack {
+      factory := func() CacheStorage { return newStorageAdapter(newMapStorage()) }
+      return newStorageStack(partitioned(options, factory))
+    },
+    true,
+  },
+}
+
+func storageBackendNames() []string {
+  var names []string
+  for name, _ := range storageBackends {
+    names = append(names, name)
+  }
+  sort.SortStrings(names)
+  return names
+}
+
+func mapCacheStorageFactory(options *BackendOptions) CacheStorageFactory {
+  return func() CacheStorage { return newMapCacheStorage(options.memory, options.slabs) }
+}
+
+/* a single storage or a HashingStorage spreading keys over several of them */
+func partitioned(options *BackendOptions, factory CacheStorageFactory) CacheStorage {
+  if options.partitions > 1 {
+    logger.Printf("Building storage with partitioning support: %d slots", options.partitions)
+    return newHashingStorage(uint32(options.partitions), factory)
+  }
+  return factory()
+}
+
+func buildGenerationalBackend(options *BackendOptions) *StorageStack {
+  storage := partitioned(options, mapCacheStorageFactory(options))
+  stack := newStorageStack(storage)
+  stack.updatesChannel = make(chan UpdateMessage, 5000)
+  //go updateMessageLogger(stack.updatesChannel)
+  stack.storage = newEventNotifierStorage(storage, stack.updatesChannel)
+  stack.generational = newGenerationalStorage(storage, stack.updatesChannel)
+  return stack
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+  "os"
+  "io"
+  "time"
+  "strconv"
+  "encoding/binary"
+  "sync/atomic"
+)
+
+/* memcached binary protocol, see
+   http://code.google.com/p/memcached/wiki/BinaryProtocolRevamped */
+
+const (
+  binaryRequestMagic  = 0x80
+  binaryResponseMagic = 0x81
+  binaryHeaderLength  = 24
+  binaryMaxKeyLength  = 250
+  binaryMaxExtras     = 255
+)
+
+const (
+  opGet     = 0x00
+  opSet     = 0x01
+  opAdd     = 0x02
+  opReplace = 0x03
+  opDelete  = 0x04
+  opIncr    = 0x05
+  opDecr    = 0x06
+  opQuit    = 0x07
+  opFlush   = 0x08
+  opGetq    = 0x09
+  opNoop    = 0x0a
+  opVersion = 0x0b
+  opGetk    = 0x0c
+  opGetkq   = 0x0d
+  opAppend  = 0x0e
+  opPrepend = 0x0f
+  opStat    = 0x10
+  opTouch   = 0x1c
+  opGat     = 0x1d
+  opGatq    = 0x1e
+
+  opSaslListMechs = 0x20
+  opSaslAuth      = 0x21
+  opSaslStep      = 0x22
+)
+
+const (
+  statusOk               = 0x00
+  statusKeyNotFound      = 0x01
+  statusKeyExists        = 0x02
+  statusInvalidArguments = 0x04
+  statusItemNotStored    = 0x05
+  statusNonNumeric       = 0x06
+  statusAuthError        = 0x20
+  statusUnknownCommand   = 0x81
+  statusNotSupported     = 0x83
+)
+
+/* opcodes that modify the storage */
+var binaryWrites = map[uint8]bool{
+  opSet: true, opAdd: true, opReplace: true, opDelete: true, opIncr: true, opDecr: true,
+  opFlush: true, opAppend: true, opPrepend: true, opTouch: true, opGat: true, opGatq: true,
+}
+
+var binaryStatusMessages = map[uint16]string{
+  statusKeyNotFound:      "Not found",
+  statusKeyExists:        "Data exists for key.",
+  statusInvalidArguments: "Invalid arguments",
+  statusItemNotStored:    "Not stored.",
+  statusNonNumeric:       "Non-numeric server-side value for incr or decr",
+  statusAuthError:        "Auth failure",
+  statusUnknownCommand:   "Unknown command",
+  statusNotSupported:     "Read only replica",
+}
+
+type BinaryRequest struct {
+  opcode  uint8
+  opaque  uint32
+  cas     uint64
+  extras  []byte
+  key     string
+  value   []byte
+}
+
+/* whether the client speaks the binary protocol, judging by its first byte */
+func (s *Session) isBinary() bool {
+  magic, err := s.bufreader.Peek(1)
+  return err == nil && magic[0] == binaryRequestMagic
+}
+
+func readBinaryRequest(r io.Reader) (*BinaryRequest, os.Error) {
+  header := make([]byte, binaryHeaderLength)
+  if _, err := io.ReadFull(r, header); err != nil {
+    return nil, err
+  }
+  if header[0] != binaryRequestMagic {
+    return nil, os.NewError("Bad binary request magic")
+  }
+  keylen := uint32(binary.BigEndian.Uint16(header[2:4]))
+  extlen := uint32(header[4])
+  bodylen := binary.BigEndian.Uint32(header[8:12])
+  if extlen + keylen > bodylen {
+    return nil, os.NewError("Bad binary request lengths")
+  }
+  // checked before allocating, even unauthenticated clients get this far
+  if keylen > binaryMaxKeyLength || uint64(bodylen) > uint64(maxItemSize) + binaryMaxKeyLength + binaryMaxExtras {
+    return nil, os.NewError("Binary request too large")
+  }
+  body := make([]byte, bodylen)
+  if _, err := io.ReadFull(r, body); err != nil {
+    return nil, err
+  }
+  return &BinaryRequest{
+    opcode: header[1],
+    opaque: binary.BigEndian.Uint32(header[12:16]),
+    cas:    binary.BigEndian.Uint64(header[16:24]),
+    extras: body[:extlen],
+    key:    string(body[extlen:extlen+keylen]),
+    value:  body[extlen+keylen:],
+  }, nil
+}
+
+func (s *Session) writeBinaryResponse(req *BinaryRequest, status uint16, cas uint64, extras []byte, key string, value []byte) {
+  bodylen := len(extras) + len(key) + len(value)
+  packet := make([]byte, binaryHeaderLength, binaryHeaderLength + len(extras) + len(key))
+  packet[0] = binaryResponseMagic
+  packet[1] = req.opcode
+  binary.BigEndian.PutUint16(packet[2:4], uint16(len(key)))
+  packet[4] = uint8(len(extras))
+  binary.BigEndian.PutUint16(packet[6:8], status)
+  binary.BigEndian.PutUint32(packet[8:12], uint32(bodylen))
+  binary.BigEndian.PutUint32(packet[12:16], req.opaque)
+  binary.BigEndian.PutUint64(packet[16:24], cas)
+  packet = append(packet, extras...)
+  packet = append(packet, []byte(key)...)
+  s.writer.Write(packet)
+  s.writeValue(value)
+}
+
+func (s *Session) binaryError(req *BinaryRequest, status uint16) {
+  s.writeBinaryResponse(req, status, 0, nil, "", []byte(binaryStatusMessages[status]))
+}
+
+func (s *Session) BinaryLoop() {
+  for {
+    req, err := readBinaryRequest(s.bufreader)
+    if err != nil || !s.begin() {
+      return
+    }
+    start := time.Nanoseconds()
+    if !s.authenticated() && req.opcode != opSaslListMechs && req.opcode != opSaslAuth && req.opcode != opSaslStep {
+      s.binaryError(req, statusAuthError)
+    } else if !s.binaryAllowed(req) {
+      s.writeBinaryResponse(req, statusAuthError, 0, nil, "", []byte("Access denied"))
+    } else if binaryWrites[req.opcode] && (follower.readOnly() || handingOff()) {
+      s.binaryError(req, statusNotSupported)
+    } else if !s.execBinary(req) {
+      return
+    }
+    observeCommand(binaryCommandNames[req.opcode], start)
+    if !s.end() {
+      return
+    }
+  }
+}
+
+/* execute a binary request, returns false when the connection must be closed */
+func (s *Session) execBinary(req *BinaryRequest) bool {
+  var storage = s.storage
+
+  switch req.opcode {
+
+  case opGet, opGetq, opGetk, opGetkq:
+    err, entry := storage.Get(req.key)
+    atomic.AddUint64(&serverStats.cmdGet, 1)
+    serverStats.hit(&serverStats.getHits, &serverStats.getMisses, err == Ok)
+    if err != Ok {
+      if req.opcode == opGet || req.opcode == opGetk {
+        s.binaryError(req, statusKeyNotFound)
+      }
+      return true
+    }
+    var key string
+    if req.opcode == opGetk || req.opcode == opGetkq {
+      key = req.key
+    }
+    s.writeBinaryResponse(req, statusOk, entry.cas_unique, binaryFlags(entry), key, entry.content)
+    entry.release()
+
+  case opSet, opAdd, opReplace:
+    if len(req.extras) != 8 || req.key == "" {
+      s.binaryError(req, statusInvalidArguments)
+      return true
+    }
+    atomic.AddUint64(&serverStats.cmdSet, 1)
+    flags := binary.BigEndian.Uint32(req.extras[0:4])
+    exptime := absoluteExptime(uint64(binary.BigEndian.Uint32(req.extras[4:8])))
+    bytes := uint32(len(req.value))
+    var err ErrorCode
+    var result *StorageEntry
+    switch {
+    case req.cas != 0 && req.opcode != opAdd:
+      err, _, result = storage.Cas(req.key, flags, exptime, bytes, req.cas, req.value)
+    case req.opcode == opSet:
+      _, result = storage.Set(req.key, flags, exptime, bytes, req.value)
+    case req.opcode == opAdd:
+      err, result = storage.Add(req.key, flags, exptime, bytes, req.value)
+    case req.opcode == opReplace:
+      err, _, result = storage.Replace(req.key, flags, exptime, bytes, req.value)
+    }
+    switch err {
+    case Ok:
+      s.writeBinaryResponse(req, statusOk, result.cas_unique, nil, "", nil)
+    case KeyNotFound:
+      s.binaryError(req, statusKeyNotFound)
+    default:
+      s.binaryError(req, statusKeyExists)
+    }
+
+  case opAppend, opPrepend:
+    var err ErrorCode
+    var result *StorageEntry
+    atomic.AddUint64(&serverStats.cmdSet, 1)
+    if req.opcode == opAppend {
+      err, _, result = storage.Append(req.key, uint32(len(req.value)), req.value)
+    } else {
+      err, _, result = storage.Prepend(req.key, uint32(len(req.value)), req.value)
+    }
+    if err != Ok {
+      s.binaryError(req, statusItemNotStored)
+    } else {
+      s.writeBinaryResponse(req, statusOk, result.cas_unique, nil, "", nil)
+    }
+
+  case opDelete:
+    if req.cas != 0 {
+      if err, entry := storage.Get(req.key); err == Ok {
+        entry.release()
+        if entry.cas_unique != req.cas {
+          s.binaryError(req, statusKeyExists)
+          return true
+        }
+      }
+    }
+    err, _ := storage.Delete(req.key)
+    serverStats.hit(&serverStats.deleteHits, &serverStats.deleteMisses, err == Ok)
+    if err != Ok {
+      s.binaryError(req, statusKeyNotFound)
+    } else {
+      s.writeBinaryResponse(req, statusOk, 0, nil, "", nil)
+    }
+
+  case opIncr, opDecr:
+    if len(req.extras) != 20 {
+      s.binaryError(req, statusInvalidArguments)
+      return true
+    }
+    s.binaryArithmetic(req)
+
+  case opTouch, opGat, opGatq:
+    if len(req.extras) != 4 {
+      s.binaryError(req, statusInvalidArguments)
+      return true
+    }
+    exptime := absoluteExptime(uint64(binary.BigEndian.Uint32(req.extras)))
+    err, _, entry := storage.Touch(req.key, exptime)
+    atomic.AddUint64(&serverStats.cmdTouch, 1)
+    serverStats.hit(&serverStats.touchHits, &serverStats.touchMisses, err == Ok)
+    if err == Ok && req.opcode != opTouch {
+      // the value is sent from a fetched reference to its content
+      err, entry = storage.Get(req.key)
+    }
+    switch {
+    case err != Ok && req.opcode != opGatq:
+      s.binaryError(req, statusKeyNotFound)
+    case err != Ok:
+    case req.opcode == opTouch:
+      s.writeBinaryResponse(req, statusOk, entry.cas_unique, nil, "", nil)
+    default:
+      s.writeBinaryResponse(req, statusOk, entry.cas_unique, binaryFlags(entry), "", entry.content)
+      entry.release()
+    }
+
+  case opFlush:
+    var exptime uint32
+    if len(req.extras) == 4 {
+      exptime = absoluteExptime(uint64(binary.BigEndian.Uint32(req.extras)))
+    }
+    atomic.AddUint64(&serverStats.cmdFlush, 1)
+    flushAll(storage, exptime)
+    s.writeBinaryResponse(req, statusOk, 0, nil, "", nil)
+
+  case opNoop:
+    s.writeBinaryResponse(req, statusOk, 0, nil, "", nil)
+
+  case opVersion:
+    s.writeBinaryResponse(req, statusOk, 0, nil, "", []byte(Version))
+
+  case opStat:
+    if req.key != "" {
+      s.binaryError(req, statusKeyNotFound)
+      return true
+    }
+    for _, stat := range serverStats.general() {
+      s.writeBinaryResponse(req, statusOk, 0, nil, stat.name, []byte(stat.value))
+    }
+    s.writeBinaryResponse(req, statusOk, 0, nil, "", nil)
+
+  case opQuit:
+    s.writeBinaryResponse(req, statusOk, 0, nil, "", nil)
+    return false
+
+  case opSaslListMechs, opSaslAuth, opSaslStep:
+    // PLAIN completes in a single step
+    if passwords == nil {
+      s.binaryError(req, statusUnknownCommand)
+    } else if req.opcode == opSaslListMechs {
+      s.writeBinaryResponse(req, statusOk, 0, nil, "", []byte(saslMechanisms))
+    } else if req.key != "PLAIN" {
+      s.binaryError(req, statusAuthError)
+    } else if user := passwords.plain(req.value); user == "" {
+      s.binaryError(req, statusAuthError)
+    } else {
+      s.user = user
+      s.writeBinaryResponse(req, statusOk, 0, nil, "", []byte("Authenticated"))
+    }
+
+  default:
+    s.binaryError(req, statusUnknownCommand)
+  }
+  return true
+}
+
+/* incr/decr. A missing key is created with the initial value unless the
+   expiration is all ones */
+func (s *Session) binaryArithmetic(req *BinaryRequest) {
+  var storage = s.storage
+  delta := binary.BigEndian.Uint64(req.extras[0:8])
+  initial := binary.BigEndian.Uint64(req.extras[8:16])
+  exptime := binary.BigEndian.Uint32(req.extras[16:20])
+  incr := req.opcode == opIncr
+
+  err, _, result := storage.Incr(req.key, delta, incr)
+  var value uint64
+  if err == Ok {
+    value, _ = strconv.Atoui64(string(result.content))
+  } else if err == KeyNotFound && exptime != 0xffffffff {
+    content := []byte(strconv.Uitoa64(initial))
+    if err, result = storage.Add(req.key, 0, absoluteExptime(uint64(exptime)), uint32(len(content)), content); err == Ok {
+      value = initial
+    } else if err, _, result = storage.Incr(req.key, delta, incr); err == Ok {
+      value, _ = strconv.Atoui64(string(result.content))
+    }
+  }
+  if incr {
+    serverStats.hit(&serverStats.incrHits, &serverStats.incrMisses, err == Ok)
+  } else {
+    serverStats.hit(&serverStats.decrHits, &serverStats.decrMisses, err == Ok)
+  }
+
+  switch err {
+  case Ok:
+    body := make([]byte, 8)
+    binary.BigEndian.PutUint64(body, value)
+    s.writeBinaryResponse(req, statusOk, result.cas_unique, nil, "", body)
+  case IllegalParameter:
+    s.binaryError(req, statusNonNumeric)
+  default:
+    s.binaryError(req, statusKeyNotFound)
+  }
+}
+
+func binaryFlags(entry *StorageEntry) []byte {
+  extras := make([]byte, 4)
+  binary.BigEndian.PutUint32(extras, entry.flags)
+  return extras
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "bytes"
+  "testing"
+  "encoding/binary"
+)
+
+/* a request frame */
+func binaryRequest(opcode uint8, opaque uint32, cas uint64, extras []byte, key string, value []byte) []byte {
+  frame := make([]byte, binaryHeaderLength)
+  frame[0] = binaryRequestMagic
+  frame[1] = opcode
+  binary.BigEndian.PutUint16(frame[2:4], uint16(len(key)))
+  frame[4] = uint8(len(extras))
+  binary.BigEndian.PutUint32(frame[8:12], uint32(len(extras) + len(key) + len(value)))
+  binary.BigEndian.PutUint32(frame[12:16], opaque)
+  binary.BigEndian.PutUint64(frame[16:24], cas)
+  frame = append(frame, extras...)
+  frame = append(frame, []byte(key)...)
+  return append(frame, value...)
+}
+
+/* the response frame the session should write */
+func binaryResponse(opcode uint8, status uint16, opaque uint32, cas uint64, extras []byte, key string, value []byte) []byte {
+  frame := binaryRequest(opcode, opaque, cas, extras, key, value)
+  frame[0] = binaryResponseMagic
+  binary.BigEndian.PutUint16(frame[6:8], status)
+  return frame
+}
+
+func binaryErrorResponse(opcode uint8, status uint16, opaque uint32) []byte {
+  return binaryResponse(opcode, status, opaque, 0, nil, "", []byte(binaryStatusMessages[status]))
+}
+
+/* the output of a session served the frames */
+func binaryReplies(storage CacheStorage, frames ...[]byte) []byte {
+  conn := &recordingConn{input: bytes.NewBuffer(bytes.Join(frames, nil))}
+  session, _ := NewSession(conn, storage)
+  session.serve()
+  return conn.output.Bytes()
+}
+
+func uint32Extras(value uint32) []byte {
+  extras := make([]byte, 4)
+  binary.BigEndian.PutUint32(extras, value)
+  return extras
+}
+
+func storeExtras(flags uint32, exptime uint32) []byte {
+  return append(uint32Extras(flags), uint32Extras(exptime)...)
+}
+
+func arithmeticExtras(delta uint64, initial uint64, exptime uint32) []byte {
+  extras := make([]byte, 16)
+  binary.BigEndian.PutUint64(extras[0:8], delta)
+  binary.BigEndian.PutUint64(extras[8:16], initial)
+  return append(extras, uint32Extras(exptime)...)
+}
+
+func casOf(storage CacheStorage, key string) uint64 {
+  if _, entry := storage.Get(key); entry != nil {
+    return entry.cas_unique
+  }
+  return 0
+}
+
+func assertFrames(t *testing.T, got []byte, want []byte, cause string) {
+  if !bytes.Equal(got, want) {
+    t.Errorf("%s: got % x, want % x", cause, got, want)
+  }
+}
+
+func TestReadBinaryRequest(t *testing.T) {
+
+  frame := binaryRequest(opSet, 0xdeadbeef, 42, storeExtras(7, 0), "foo", []byte("bar"))
+  req, err := readBinaryRequest(bytes.NewBuffer(frame))
+  assertEquals(t, err == nil, true, "request not parsed")
+  assertEquals(t, req.opcode, uint8(opSet), "wrong opcode")
+  assertEquals(t, req.opaque, uint32(0xdeadbeef), "wrong opaque")
+  assertEquals(t, req.cas, uint64(42), "wrong cas")
+  assertEquals(t, len(req.extras), 8, "wrong extras")
+  assertEquals(t, req.key, "foo", "wrong key")
+  assertEquals(t, string(req.value), "bar", "wrong value")
+
+  frame[0] = binaryResponseMagic
+  _, err = readBinaryRequest(bytes.NewBuffer(frame))
+  assertEquals(t, err != nil, true, "bad magic accepted")
+
+  frame = binaryRequest(opGet, 0, 0, nil, "foo", nil)
+  binary.BigEndian.PutUint32(frame[8:12], 2)
+  _, err = readBinaryRequest(bytes.NewBuffer(frame))
+  assertEquals(t, err != nil, true, "key longer than the body accepted")
+}
+
+func TestBinaryOversizedBodyIsRejected(t *testing.T) {
+
+  // only the header is sent, the body must not be waited for
+  frame := binaryRequest(opSet, 0, 0, storeExtras(0, 0), "foo", nil)
+  binary.BigEndian.PutUint32(frame[8:12], uint32(maxItemSize) + binaryMaxKeyLength + binaryMaxExtras + 1)
+  _, err := readBinaryRequest(bytes.NewBuffer(frame))
+  assertEquals(t, err != nil && err.String() == "Binary request too large", true, "oversized body accepted")
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  replies := binaryReplies(storage, frame, binaryRequest(opNoop, 1, 0, nil, "", nil))
+  assertEquals(t, len(replies), 0, "connection not closed on an oversized body")
+}
+
+func TestBinaryQuietOpcodesOnlyReplyOnHits(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("foo", 3, 0, 3, []byte("bar"))
+  cas := casOf(storage, "foo")
+
+  replies := binaryReplies(storage,
+    binaryRequest(opGetq, 1, 0, nil, "missing", nil),
+    binaryRequest(opGetkq, 2, 0, nil, "missing", nil),
+    binaryRequest(opGatq, 3, 0, uint32Extras(0), "missing", nil),
+    binaryRequest(opGetkq, 4, 0, nil, "foo", nil),
+    binaryRequest(opNoop, 5, 0, nil, "", nil))
+  assertFrames(t, replies, bytes.Join([][]byte{
+    binaryResponse(opGetkq, statusOk, 4, cas, uint32Extras(3), "foo", []byte("bar")),
+    binaryResponse(opNoop, statusOk, 5, 0, nil, "", nil),
+  }, nil), "quiet misses answered")
+}
+
+func TestBinaryGetkEchoesTheKey(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("foo", 3, 0, 3, []byte("bar"))
+  cas := casOf(storage, "foo")
+
+  replies := binaryReplies(storage,
+    binaryRequest(opGetk, 1, 0, nil, "foo", nil),
+    binaryRequest(opGet, 2, 0, nil, "foo", nil),
+    binaryRequest(opGetk, 3, 0, nil, "missing", nil))
+  assertFrames(t, replies, bytes.Join([][]byte{
+    binaryResponse(opGetk, statusOk, 1, cas, uint32Extras(3), "foo", []byte("bar")),
+    binaryResponse(opGet, statusOk, 2, cas, uint32Extras(3), "", []byte("bar")),
+    binaryErrorResponse(opGetk, statusKeyNotFound, 3),
+  }, nil), "wrong get replies")
+}
+
+func TestBinaryEchoesCasAndOpaque(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  replies := binaryReplies(storage, binaryRequest(opSet, 0xdeadbeef, 0, storeExtras(0, 0), "foo", []byte("bar")))
+  first := casOf(storage, "foo")
+  assertFrames(t, replies, binaryResponse(opSet, statusOk, 0xdeadbeef, first, nil, "", nil), "wrong set reply")
+
+  replies = binaryReplies(storage, binaryRequest(opSet, 1, first, storeExtras(0, 0), "foo", []byte("baz")))
+  second := casOf(storage, "foo")
+  assertNotEquals(t, second, first, "cas not changed")
+  assertFrames(t, replies, binaryResponse(opSet, statusOk, 1, second, nil, "", nil), "wrong cas reply")
+
+  replies = binaryReplies(storage, binaryRequest(opSet, 2, first, storeExtras(0, 0), "foo", []byte("qux")))
+  assertFrames(t, replies, binaryErrorResponse(opSet, statusKeyExists, 2), "stale cas stored")
+  assertEquals(t, holds(storage, "foo", "baz")(), true, "stale cas changed the value")
+}
+
+func TestBinaryIncrCreatesWithTheInitialValue(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  replies := binaryReplies(storage, binaryRequest(opIncr, 1, 0, arithmeticExtras(5, 10, 100), "counter", nil))
+  _, entry := storage.Get("counter")
+  value := make([]byte, 8)
+  binary.BigEndian.PutUint64(value, 10)
+  assertFrames(t, replies, binaryResponse(opIncr, statusOk, 1, casOf(storage, "counter"), nil, "", value), "initial value not replied")
+  assertEquals(t, entry != nil && entry.exptime != 0, true, "exptime of the new counter not set")
+
+  replies = binaryReplies(storage, binaryRequest(opIncr, 2, 0, arithmeticExtras(5, 10, 100), "counter", nil))
+  binary.BigEndian.PutUint64(value, 15)
+  assertFrames(t, replies, binaryResponse(opIncr, statusOk, 2, casOf(storage, "counter"), nil, "", value), "counter not incremented")
+
+  replies = binaryReplies(storage, binaryRequest(opDecr, 3, 0, arithmeticExtras(1, 10, 0xffffffff), "missing", nil))
+  assertFrames(t, replies, binaryErrorResponse(opDecr, statusKeyNotFound, 3), "counter created despite an all ones exptime")
+}
+
+func TestBinaryGat(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("foo", 3, 0, 3, []byte("bar"))
+
+  replies := binaryReplies(storage, binaryRequest(opGat, 1, 0, uint32Extras(100), "foo", nil))
+  _, entry := storage.Get("foo")
+  assertFrames(t, replies, binaryResponse(opGat, statusOk, 1, entry.cas_unique, uint32Extras(3), "", []byte("bar")), "wrong gat reply")
+  assertEquals(t, entry.exptime != 0, true, "gat didn't touch")
+
+  replies = binaryReplies(storage, binaryRequest(opGat, 2, 0, uint32Extras(100), "missing", nil))
+  assertFrames(t, replies, binaryErrorResponse(opGat, statusKeyNotFound, 2), "wrong gat miss")
+}
+
+func TestBinaryFlush(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("foo", 0, 0, 3, []byte("bar"))
+
+  replies := binaryReplies(storage,
+    binaryRequest(opFlush, 1, 0, nil, "", nil),
+    binaryRequest(opGet, 2, 0, nil, "foo", nil))
+  assertFrames(t, replies, bytes.Join([][]byte{
+    binaryResponse(opFlush, statusOk, 1, 0, nil, "", nil),
+    binaryErrorResponse(opGet, statusKeyNotFound, 2),
+  }, nil), "items survived a flush")
+}
+
+func TestBinarySaslGatesRequests(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test_binary_passwords"
+  defer os.Remove(path)
+  ioutil.WriteFile(path, []byte("web:secret\n"), 0600)
+  file, err := newPasswordFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer func() { passwords = nil }()
+  passwords = file
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("foo", 0, 0, 3, []byte("bar"))
+  cas := casOf(storage, "foo")
+
+  replies := binaryReplies(storage,
+    binaryRequest(opGet, 1, 0, nil, "foo", nil),
+    binaryRequest(opSaslListMechs, 2, 0, nil, "", nil),
+    binaryRequest(opSaslAuth, 3, 0, nil, "PLAIN", []byte("\x00web\x00wrong")),
+    binaryRequest(opGet, 4, 0, nil, "foo", nil),
+    binaryRequest(opSaslAuth, 5, 0, nil, "PLAIN", []byte("\x00web\x00secret")),
+    binaryRequest(opGet, 6, 0, nil, "foo", nil))
+  assertFrames(t, replies, bytes.Join([][]byte{
+    binaryErrorResponse(opGet, statusAuthError, 1),
+    binaryResponse(opSaslListMechs, statusOk, 2, 0, nil, "", []byte(saslMechanisms)),
+    binaryErrorResponse(opSaslAuth, statusAuthError, 3),
+    binaryErrorResponse(opGet, statusAuthError, 4),
+    binaryResponse(opSaslAuth, statusOk, 5, 0, nil, "", []byte("Authenticated")),
+    binaryResponse(opGet, statusOk, 6, cas, uint32Extras(0), "", []byte("bar")),
+  }, nil), "requests not gated by authentication")
+}
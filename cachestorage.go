@@ -1,5 +1,11 @@
 package main
 
+import (
+  "time"
+  "sync/atomic"
+  "container/list"
+)
+
 const (
   Ok = iota
   KeyAlreadyInUse
@@ -9,16 +15,89 @@ const (
 
 type ErrorCode uint;
 
+/* cas unique values come from a single server-wide sequence so they are never
+   handed out twice, whatever the key or storage partition */
+var casCounter uint64
+var casDisabled bool
+
+func nextCas() uint64 {
+  if casDisabled {
+    return 0
+  }
+  return atomic.AddUint64(&casCounter, 1)
+}
+
 type StorageEntry struct {
   exptime    uint32
   flags      uint32
   bytes      uint32
   cas_unique uint64
   content    []byte
+  fetched    bool   // whether the entry was ever fetched
+  lastAccess uint32 // time of the last fetch or store
+  // fetched and lastAccess as they were right before the latest fetch
+  wasFetched bool
+  prevAccess uint32
+  // meta protocol invalidation and win token state, accessed atomically
+  stale      uint32
+  won        uint32
+  lruElement *list.Element
+  chunk      *SlabChunk // memory holding content, nil if left to the heap
+}
+
+func newStorageEntry(exptime uint32, flags uint32, bytes uint32, cas_unique uint64, content []byte) *StorageEntry {
+  return &StorageEntry{exptime: exptime, flags: flags, bytes: bytes, cas_unique: cas_unique, content: content,
+                       lastAccess: uint32(time.Seconds())}
+}
+
+/* record a fetch of this entry. The caller must hold the storage write lock */
+func (self *StorageEntry) fetch() {
+  self.wasFetched, self.prevAccess = self.fetched, self.lastAccess
+  self.fetched, self.lastAccess = true, uint32(time.Seconds())
+}
+
+/* seconds left until the entry expires, -1 if it never does */
+func (self *StorageEntry) ttl() int64 {
+  if self.exptime == 0 {
+    return -1
+  }
+  return int64(self.exptime) - time.Seconds()
+}
+
+/* take a reference to the entry content so it isn't recycled while in use */
+func (self *StorageEntry) acquire() {
+  if self.chunk != nil {
+    self.chunk.acquire()
+  }
+}
+
+func (self *StorageEntry) release() {
+  if self.chunk != nil {
+    self.chunk.release()
+  }
+}
+
+func (self *StorageEntry) markStale() {
+  atomic.CompareAndSwapUint32(&self.stale, 0, 1)
+}
+
+func (self *StorageEntry) isStale() bool {
+  return atomic.LoadUint32(&self.stale) == 1
+}
+
+/* hand out the win token for this entry, true only for the first caller */
+func (self *StorageEntry) claimWin() bool {
+  return atomic.CompareAndSwapUint32(&self.won, 0, 1)
+}
+
+func (self *StorageEntry) winClaimed() bool {
+  return atomic.LoadUint32(&self.won) == 1
 }
 
 type CacheStorageFactory func() CacheStorage
 
+/* Content passed to a storage is only valid during the call, sessions reuse
+   their read buffers. */
 type CacheStorage interface {
 
   // Store this data.
@@ -40,7 +119,8 @@ type CacheStorage interface {
   // only if no one else has updated since I last fetched it"
   Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
 
-  // Retrieve the stored data for a given key 
+  // Retrieve the stored data for a given key. The result holds a reference to
+  // its content that must be released once the caller is done with it
   Get(key string) (err ErrorCode, result *StorageEntry)
 
   // Delete the stored data for a given key 
@@ -53,5 +133,16 @@ type CacheStorage interface {
   // that a non-existent key exists with value 0; instead, they will fail. 
   Incr(key string, value uint64, incr bool) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
 
+  // Update the expiration time of an existing item without fetching it
+  Touch(key string, exptime uint32) (err ErrorCode, previous *StorageEntry, result *StorageEntry)
+
+  // Invalidate all the existing items right away, delayed flushes are
+  // scheduled by flushAll
+  Flush()
+
+  // Call f for every live entry. Entries are only valid during the call, and
+  // the storage may be locked while f runs
+  Walk(f func(key string, entry *StorageEntry))
+
   Expire(key string)
 }
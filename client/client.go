@@ -0,0 +1,425 @@
+/* Package client talks to gocached, or any memcached, over the text protocol.
+   Keys are spread over the servers with a ketama consistent hash ring */
+package client
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "bytes"
+  "sync"
+  "time"
+  "strings"
+  "strconv"
+)
+
+const (
+  DefaultTimeout      = 1e9
+  DefaultMaxIdle      = 4
+  DefaultRetries      = 2
+  DefaultFailureLimit = 3
+  DefaultRetryTimeout = 30e9
+)
+
+var (
+  ErrCacheMiss    = os.NewError("client: cache miss")
+  ErrNotStored    = os.NewError("client: item not stored")
+  ErrCasConflict  = os.NewError("client: compare-and-swap conflict")
+  ErrMalformedKey = os.NewError("client: malformed key")
+  ErrNoServers    = os.NewError("client: no servers available")
+)
+
+/* an error reply from the server, the connection remains usable */
+type ServerError string
+
+func (self ServerError) String() string {
+  return "client: server error: " + string(self)
+}
+
+type Item struct {
+  Key        string
+  Value      []byte
+  Flags      uint32
+  Expiration int32  // seconds from now or a unix timestamp, as in memcached
+  Cas        uint64 // set by Get and GetMulti, compared by Cas
+}
+
+/* Client is safe for concurrent use. Its settings may be changed before the
+   first request is made */
+type Client struct {
+  Timeout      int64 // nanoseconds a connect, read or write may take, 0 waits forever
+  MaxIdle      int   // idle connections kept per server
+  Retries      int   // times a request failing on a connection error is retried
+  FailureLimit int   // consecutive failures ejecting a server from the ring
+  RetryTimeout int64 // nanoseconds before an ejected server is tried again
+
+  servers      []*server
+  lock         sync.RWMutex
+  ring         ring
+  nextRevival  int64
+}
+
+func New(addrs ...string) *Client {
+  client := &Client{
+    Timeout:      DefaultTimeout,
+    MaxIdle:      DefaultMaxIdle,
+    Retries:      DefaultRetries,
+    FailureLimit: DefaultFailureLimit,
+    RetryTimeout: DefaultRetryTimeout,
+  }
+  for _, addr := range addrs {
+    client.servers = append(client.servers, &server{addr: addr})
+  }
+  client.rebuild()
+  return client
+}
+
+/* build the ring from the servers that aren't ejected, giving back the ones
+   whose ejection is over */
+func (self *Client) rebuild() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  now := time.Nanoseconds()
+  var live []*server
+  self.nextRevival = 0
+  for _, server := range self.servers {
+    server.lock.Lock()
+    if server.ejectedUntil != 0 && server.ejectedUntil <= now {
+      server.ejectedUntil, server.failures = 0, 0
+    }
+    if server.ejectedUntil == 0 {
+      live = append(live, server)
+    } else if self.nextRevival == 0 || server.ejectedUntil < self.nextRevival {
+      self.nextRevival = server.ejectedUntil
+    }
+    server.lock.Unlock()
+  }
+  self.ring = newRing(live)
+}
+
+func (self *Client) pick(key string) (*server, os.Error) {
+  self.lock.RLock()
+  revive := self.nextRevival != 0 && self.nextRevival <= time.Nanoseconds()
+  self.lock.RUnlock()
+  if revive {
+    self.rebuild()
+  }
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  if server := self.ring.lookup(key); server != nil {
+    return server, nil
+  }
+  return nil, ErrNoServers
+}
+
+/* replies that leave the connection in a known state */
+func isResponseError(err os.Error) bool {
+  if _, ok := err.(ServerError); ok {
+    return true
+  }
+  return err == nil || err == ErrCacheMiss || err == ErrNotStored || err == ErrCasConflict
+}
+
+/* whether err means no server could answer, as opposed to a reply */
+func IsUnavailable(err os.Error) bool {
+  return !isResponseError(err) && err != ErrMalformedKey
+}
+
+/* run f on a connection to the server owning key. Connection errors eject
+   failing servers and, when retry is set, are retried on whichever server
+   owns the key by then */
+func (self *Client) withServer(key string, retry bool, f func(cn *conn) os.Error) os.Error {
+  if !legalKey(key) {
+    return ErrMalformedKey
+  }
+  var err os.Error
+  for attempt := 0; attempt == 0 || retry && attempt <= self.Retries; attempt++ {
+    server, pickErr := self.pick(key)
+    if pickErr != nil {
+      return pickErr
+    }
+    var cn *conn
+    if cn, err = self.getConn(server); err == nil {
+      if err = f(cn); isResponseError(err) {
+        self.succeeded(server)
+        self.putConn(cn)
+        return err
+      }
+      cn.nc.Close()
+    }
+    self.failed(server)
+  }
+  return err
+}
+
+func legalKey(key string) bool {
+  if len(key) == 0 || len(key) > 250 {
+    return false
+  }
+  for i := 0; i < len(key); i++ {
+    if key[i] <= ' ' || key[i] == 0x7f {
+      return false
+    }
+  }
+  return true
+}
+
+/* read a reply line without its line terminator */
+func readLine(cn *conn) (string, os.Error) {
+  line, err := cn.rw.ReadString('\n')
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimRight(line, "\r\n"), nil
+}
+
+/* the error for a reply nothing else expected */
+func replyError(line string) os.Error {
+  switch {
+  case line == "ERROR", strings.HasPrefix(line, "CLIENT_ERROR "), strings.HasPrefix(line, "SERVER_ERROR "):
+    return ServerError(line)
+  }
+  return os.NewError("client: unexpected reply: " + line)
+}
+
+/* parse VALUE lines until END, calling f for each item */
+func readValues(cn *conn, f func(item *Item)) os.Error {
+  for {
+    line, err := readLine(cn)
+    if err != nil {
+      return err
+    } else if line == "END" {
+      return nil
+    }
+    fields := strings.Fields(line)
+    if len(fields) < 4 || fields[0] != "VALUE" {
+      return replyError(line)
+    }
+    item := &Item{Key: fields[1]}
+    flags, err := strconv.Atoui64(fields[2])
+    if err != nil {
+      return replyError(line)
+    }
+    item.Flags = uint32(flags)
+    size, err := strconv.Atoi(fields[3])
+    if err != nil {
+      return replyError(line)
+    }
+    if len(fields) > 4 {
+      if item.Cas, err = strconv.Atoui64(fields[4]); err != nil {
+        return replyError(line)
+      }
+    }
+    data := make([]byte, size + 2)
+    if _, err = io.ReadFull(cn.rw, data); err != nil {
+      return err
+    } else if !bytes.HasSuffix(data, []byte("\r\n")) {
+      return replyError(string(data))
+    }
+    item.Value = data[:size]
+    f(item)
+  }
+  return nil
+}
+
+/* send a command line and read the single line replying to it */
+func (self *Client) command(cn *conn, data []byte, format string, args ...interface{}) (string, os.Error) {
+  fmt.Fprintf(cn.rw, format, args...)
+  if data != nil {
+    cn.rw.Write(data)
+    cn.rw.WriteString("\r\n")
+  }
+  if err := cn.rw.Flush(); err != nil {
+    return "", err
+  }
+  return readLine(cn)
+}
+
+func (self *Client) Get(key string) (item *Item, err os.Error) {
+  err = self.withServer(key, true, func(cn *conn) os.Error {
+    fmt.Fprintf(cn.rw, "gets %s\r\n", key)
+    if err := cn.rw.Flush(); err != nil {
+      return err
+    }
+    return readValues(cn, func(found *Item) { item = found })
+  })
+  if err == nil && item == nil {
+    err = ErrCacheMiss
+  }
+  return
+}
+
+/* fetch several keys with one request per server. Missing keys are left out
+   of the result. When a server fails the items found on the others are
+   returned along with the error */
+func (self *Client) GetMulti(keys []string) (map[string]*Item, os.Error) {
+  groups := make(map[*server][]string)
+  for _, key := range keys {
+    if !legalKey(key) {
+      return nil, ErrMalformedKey
+    }
+    server, err := self.pick(key)
+    if err != nil {
+      return nil, err
+    }
+    groups[server] = append(groups[server], key)
+  }
+
+  type fetched struct {
+    items []*Item
+    err   os.Error
+  }
+  results := make(chan fetched, len(groups))
+  for _, group := range groups {
+    go func(group []string) {
+      var items []*Item
+      err := self.withServer(group[0], true, func(cn *conn) os.Error {
+        items = nil
+        fmt.Fprintf(cn.rw, "gets %s\r\n", strings.Join(group, " "))
+        if err := cn.rw.Flush(); err != nil {
+          return err
+        }
+        return readValues(cn, func(item *Item) { items = append(items, item) })
+      })
+      results <- fetched{items, err}
+    }(group)
+  }
+
+  found := make(map[string]*Item)
+  var err os.Error
+  for i := 0; i < len(groups); i++ {
+    result := <-results
+    for _, item := range result.items {
+      found[item.Key] = item
+    }
+    if result.err != nil {
+      err = result.err
+    }
+  }
+  return found, err
+}
+
+func storeReply(line string) os.Error {
+  switch line {
+  case "STORED":
+    return nil
+  case "NOT_STORED":
+    return ErrNotStored
+  case "EXISTS":
+    return ErrCasConflict
+  case "NOT_FOUND":
+    return ErrCacheMiss
+  }
+  return replyError(line)
+}
+
+func (self *Client) store(command string, item *Item) os.Error {
+  value := item.Value
+  if value == nil {
+    // an empty data block still has to be sent
+    value = []byte{}
+  }
+  return self.withServer(item.Key, true, func(cn *conn) os.Error {
+    var line string
+    var err os.Error
+    if command == "cas" {
+      line, err = self.command(cn, value, "cas %s %d %d %d %d\r\n", item.Key, item.Flags, item.Expiration, len(value), item.Cas)
+    } else {
+      line, err = self.command(cn, value, "%s %s %d %d %d\r\n", command, item.Key, item.Flags, item.Expiration, len(value))
+    }
+    if err != nil {
+      return err
+    }
+    return storeReply(line)
+  })
+}
+
+func (self *Client) Set(item *Item) os.Error {
+  return self.store("set", item)
+}
+
+/* store item only if its key isn't already in use, ErrNotStored otherwise */
+func (self *Client) Add(item *Item) os.Error {
+  return self.store("add", item)
+}
+
+/* store item only if its key is already in use, ErrNotStored otherwise */
+func (self *Client) Replace(item *Item) os.Error {
+  return self.store("replace", item)
+}
+
+/* add item.Value after the current value of item.Key, its flags and
+   expiration are ignored */
+func (self *Client) Append(item *Item) os.Error {
+  return self.store("append", item)
+}
+
+/* add item.Value before the current value of item.Key */
+func (self *Client) Prepend(item *Item) os.Error {
+  return self.store("prepend", item)
+}
+
+/* store item only if it hasn't changed since item.Cas was read, returns
+   ErrCasConflict if it has and ErrCacheMiss if it is gone */
+func (self *Client) Cas(item *Item) os.Error {
+  return self.store("cas", item)
+}
+
+func (self *Client) arithmetic(command string, key string, delta uint64) (value uint64, err os.Error) {
+  // not retried, the first attempt may have been applied
+  err = self.withServer(key, false, func(cn *conn) os.Error {
+    line, err := self.command(cn, nil, "%s %s %d\r\n", command, key, delta)
+    if err != nil {
+      return err
+    } else if line == "NOT_FOUND" {
+      return ErrCacheMiss
+    } else if value, err = strconv.Atoui64(line); err != nil {
+      return replyError(line)
+    }
+    return nil
+  })
+  return
+}
+
+/* increment the decimal value of key, returning the new value */
+func (self *Client) Incr(key string, delta uint64) (uint64, os.Error) {
+  return self.arithmetic("incr", key, delta)
+}
+
+/* decrement the decimal value of key, which never goes below 0 */
+func (self *Client) Decr(key string, delta uint64) (uint64, os.Error) {
+  return self.arithmetic("decr", key, delta)
+}
+
+/* update the expiration of key without fetching it */
+func (self *Client) Touch(key string, expiration int32) os.Error {
+  return self.withServer(key, true, func(cn *conn) os.Error {
+    line, err := self.command(cn, nil, "touch %s %d\r\n", key, expiration)
+    if err != nil {
+      return err
+    }
+    switch line {
+    case "TOUCHED":
+      return nil
+    case "NOT_FOUND":
+      return ErrCacheMiss
+    }
+    return replyError(line)
+  })
+}
+
+func (self *Client) Delete(key string) os.Error {
+  return self.withServer(key, true, func(cn *conn) os.Error {
+    line, err := self.command(cn, nil, "delete %s\r\n", key)
+    if err != nil {
+      return err
+    }
+    switch line {
+    case "DELETED":
+      return nil
+    case "NOT_FOUND":
+      return ErrCacheMiss
+    }
+    return replyError(line)
+  })
+}
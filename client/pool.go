@@ -0,0 +1,112 @@
+package client
+
+import (
+  "os"
+  "net"
+  "bufio"
+  "sync"
+  "time"
+)
+
+/* a memcached server along with its idle connections and failure count */
+type server struct {
+  addr         string
+  lock         sync.Mutex
+  idle         []*conn
+  failures     int
+  ejectedUntil int64
+}
+
+type conn struct {
+  nc     net.Conn
+  rw     *bufio.ReadWriter
+  server *server
+}
+
+var ErrDialTimeout = os.NewError("client: timeout connecting to server")
+
+/* an idle connection to the server or a new one */
+func (self *Client) getConn(server *server) (*conn, os.Error) {
+  server.lock.Lock()
+  if n := len(server.idle); n > 0 {
+    cn := server.idle[n-1]
+    server.idle = server.idle[:n-1]
+    server.lock.Unlock()
+    return cn, nil
+  }
+  server.lock.Unlock()
+
+  nc, err := dial(server.addr, self.Timeout)
+  if err != nil {
+    return nil, err
+  }
+  if self.Timeout > 0 {
+    nc.SetTimeout(self.Timeout)
+  }
+  return &conn{nc, bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)), server}, nil
+}
+
+/* net.Dial giving up after timeout nanoseconds, 0 waits forever */
+func dial(addr string, timeout int64) (net.Conn, os.Error) {
+  if timeout <= 0 {
+    return net.Dial("tcp", addr)
+  }
+  type dialed struct {
+    nc  net.Conn
+    err os.Error
+  }
+  result := make(chan dialed, 1)
+  go func() {
+    nc, err := net.Dial("tcp", addr)
+    result <- dialed{nc, err}
+  }()
+  select {
+  case d := <-result:
+    return d.nc, d.err
+  case <-time.After(timeout):
+    // close the connection whenever the dial completes
+    go func() {
+      if d := <-result; d.nc != nil {
+        d.nc.Close()
+      }
+    }()
+  }
+  return nil, ErrDialTimeout
+}
+
+/* return a healthy connection to the pool */
+func (self *Client) putConn(cn *conn) {
+  server := cn.server
+  server.lock.Lock()
+  defer server.lock.Unlock()
+  if len(server.idle) < self.MaxIdle {
+    server.idle = append(server.idle, cn)
+  } else {
+    cn.nc.Close()
+  }
+}
+
+/* count a failure, ejecting the server from the ring once it has failed
+   FailureLimit times in a row */
+func (self *Client) failed(server *server) {
+  server.lock.Lock()
+  server.failures++
+  eject := server.failures >= self.FailureLimit && server.ejectedUntil == 0
+  if eject {
+    server.ejectedUntil = time.Nanoseconds() + self.RetryTimeout
+    for _, cn := range server.idle {
+      cn.nc.Close()
+    }
+    server.idle = nil
+  }
+  server.lock.Unlock()
+  if eject {
+    self.rebuild()
+  }
+}
+
+func (self *Client) succeeded(server *server) {
+  server.lock.Lock()
+  server.failures = 0
+  server.lock.Unlock()
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+  "fmt"
+  "sort"
+  "crypto/md5"
+)
+
+/* ketama continuum as built by libketama and libmemcached: every server gets
+   40 md5 digests of "address-i", each giving four points on the ring. A key
+   belongs to the first point at or after the hash of its own md5 digest */
+
+const ketamaDigestsPerServer = 40
+
+type point struct {
+  hash   uint32
+  server *server
+}
+
+type ring []point
+
+func (self ring) Len() int           { return len(self) }
+func (self ring) Less(i, j int) bool { return self[i].hash < self[j].hash }
+func (self ring) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func ketamaDigest(s string) []byte {
+  digest := md5.New()
+  digest.Write([]byte(s))
+  return digest.Sum()
+}
+
+/* the point hashed from the n-th group of four bytes of a digest */
+func ketamaPoint(digest []byte, n int) uint32 {
+  return uint32(digest[3+n*4])<<24 | uint32(digest[2+n*4])<<16 | uint32(digest[1+n*4])<<8 | uint32(digest[n*4])
+}
+
+func newRing(servers []*server) ring {
+  points := make(ring, 0, len(servers) * ketamaDigestsPerServer * 4)
+  for _, server := range servers {
+    for i := 0; i < ketamaDigestsPerServer; i++ {
+      digest := ketamaDigest(fmt.Sprintf("%s-%d", server.addr, i))
+      for n := 0; n < 4; n++ {
+        points = append(points, point{ketamaPoint(digest, n), server})
+      }
+    }
+  }
+  sort.Sort(points)
+  return points
+}
+
+/* the server owning key, nil on an empty ring */
+func (self ring) lookup(key string) *server {
+  if len(self) == 0 {
+    return nil
+  }
+  hash := ketamaPoint(ketamaDigest(key), 0)
+  i := sort.Search(len(self), func(i int) bool { return self[i].hash >= hash })
+  if i == len(self) {
+    i = 0
+  }
+  return self[i].server
+}
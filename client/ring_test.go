@@ -0,0 +1,50 @@
+package client
+
+import (
+  "fmt"
+  "testing"
+)
+
+func servers(addrs ...string) []*server {
+  var result []*server
+  for _, addr := range addrs {
+    result = append(result, &server{addr: addr})
+  }
+  return result
+}
+
+func TestRingPointsPerServer(t *testing.T) {
+  ring := newRing(servers("127.0.0.1:11211", "127.0.0.1:11212"))
+  if len(ring) != 2 * ketamaDigestsPerServer * 4 {
+    t.Error("Unexpected number of points", len(ring))
+  }
+  for i := 1; i < len(ring); i++ {
+    if ring[i-1].hash > ring[i].hash {
+      t.Fatal("Ring not sorted")
+    }
+  }
+}
+
+func TestRingMovesFewKeysWhenAddingAServer(t *testing.T) {
+  before := newRing(servers("10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"))
+  after := newRing(servers("10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211"))
+  moved := 0
+  for i := 0; i < 1000; i++ {
+    key := fmt.Sprintf("key%d", i)
+    if before.lookup(key).addr != after.lookup(key).addr {
+      if after.lookup(key).addr != "10.0.0.4:11211" {
+        t.Fatal("Key moved between existing servers", key)
+      }
+      moved++
+    }
+  }
+  if moved == 0 || moved > 400 {
+    t.Error("Unexpected number of keys moved", moved)
+  }
+}
+
+func TestEmptyRing(t *testing.T) {
+  if newRing(nil).lookup("foo") != nil {
+    t.Error("Empty ring returned a server")
+  }
+}
@@ -8,12 +8,22 @@ import (
   "strconv"
   "time"
   "fmt"
+  "sync"
+  "sync/atomic"
+  "io"
+  "io/ioutil"
+  "encoding/base64"
 )
 
 type Session struct {
-  conn      *net.TCPConn
+  conn      net.Conn
   bufreader *bufio.Reader
+  writer    io.Writer     // replies go through here, see udp.go
+  output    *bufio.Writer // buffers the replies to conn, see output.go
   storage CacheStorage
+  databuf   []byte // reused for every data block read
+  state     int32  // idle, busy or closed, see shutdown.go
+  user      string // authenticated user, see auth.go
 }
 
 type Command interface {
@@ -36,6 +46,7 @@ type StorageCommand struct {
 type RetrievalCommand struct {
   session     *Session
   command     string
+  exptime     uint32
   keys     []string
 }
 
@@ -46,6 +57,35 @@ type DeleteCommand struct {
   noreply bool
 }
 
+type ArithmeticCommand struct {
+  session     *Session
+  command     string
+  key string
+  value uint64
+  noreply bool
+}
+
+type FlushCommand struct {
+  session     *Session
+  exptime     uint32
+  noreply     bool
+}
+
+type MetaCommand struct {
+  session     *Session
+  command     string
+  key         string
+  rawKey      string   // the key as sent, base64 encoded when the b flag is set
+  datalen     uint32
+  flags       []string
+  data        []byte
+}
+
+type StatsCommand struct {
+  session     *Session
+  args        []string
+}
+
 type TouchCommand struct {
   session     *Session
   command     string
@@ -54,6 +94,15 @@ type TouchCommand struct {
   noreply bool
 }
 
+type ShutdownCommand struct {
+  session     *Session
+}
+
+type ReplicationCommand struct {
+  session     *Session
+  action      string
+}
+
 const (
   NA = iota
   UnkownCommand
@@ -61,8 +110,12 @@ const (
   ServerError
 )
 
-func NewSession(conn *net.TCPConn, store CacheStorage) (*Session, os.Error) {
-  var s = &Session{conn, bufio.NewReader(conn), store}
+func NewSession(conn net.Conn, store CacheStorage) (*Session, os.Error) {
+  output, err := bufio.NewWriterSize(conn, outputBufferSize)
+  if err != nil {
+    return nil, err
+  }
+  var s = &Session{conn: conn, bufreader: bufio.NewReader(&flushingReader{conn, output}), writer: output, output: output, storage: store}
   return s, nil
 }
 
@@ -79,32 +132,85 @@ func getTokenizedLine(r *bufio.Reader) []string {
 func (s *Session) CommandLoop() {
 
   for line := getTokenizedLine(s.bufreader);
-      line != nil; line = getTokenizedLine(s.bufreader) {
+      line != nil && s.begin(); line = getTokenizedLine(s.bufreader) {
+
+    if !s.authenticated() {
+      s.textAuthentication(line)
+      if !s.end() {
+        return
+      }
+      continue
+    }
 
+    start := time.Nanoseconds()
     switch line[0] {
 
     case "set", "add", "replace", "append", "prepend", "cas":
-      if cmd := (&StorageCommand{session: s}); cmd.parse(line) {
+      if cmd := (&StorageCommand{session: s}); cmd.parse(line) && s.mayWrite(cmd.key) && s.writable() {
         cmd.Exec()
       }
-    case "get", "gets":
-      if cmd := (&RetrievalCommand{session: s}); cmd.parse(line) {
+    case "get", "gets", "gat", "gats":
+      if cmd := (&RetrievalCommand{session: s}); cmd.parse(line) && cmd.allowed() && (!strings.HasPrefix(cmd.command, "gat") || s.writable()) {
         cmd.Exec()
       }
     case "delete":
-      if cmd := (&DeleteCommand{session: s}); cmd.parse(line) {
+      if cmd := (&DeleteCommand{session: s}); cmd.parse(line) && s.mayWrite(cmd.key) && s.writable() {
         cmd.Exec()
       }
     case "touch":
-      if cmd := (&TouchCommand{session: s}); cmd.parse(line) {
+      if cmd := (&TouchCommand{session: s}); cmd.parse(line) && s.mayWrite(cmd.key) && s.writable() {
+        cmd.Exec()
+      }
+    case "incr", "decr":
+      if cmd := (&ArithmeticCommand{session: s}); cmd.parse(line) && s.mayReadWrite(cmd.key) && s.writable() {
         cmd.Exec()
       }
-    case "incr", "decr", "stats", "flush_all", "version", "quit":
+    case "mg", "mn", "me":
+      // touching or creating the item writes, as gat does
+      if cmd := (&MetaCommand{session: s}); cmd.parse(line) && cmd.supported() && cmd.allowed() && (!cmd.writes() || s.writable()) {
+        cmd.Exec()
+      }
+    case "ms", "md", "ma":
+      if cmd := (&MetaCommand{session: s}); cmd.parse(line) && cmd.supported() && cmd.allowed() && s.writable() {
+        cmd.Exec()
+      }
+    case "stats":
+      if cmd := (&StatsCommand{session: s}); cmd.parse(line) && (len(cmd.args) == 0 || s.mayAdminister()) {
+        cmd.Exec()
+      }
+    case "flush_all":
+      if cmd := (&FlushCommand{session: s}); cmd.parse(line) && s.mayAdminister() && s.writable() {
+        cmd.Exec()
+      }
+    case "replication":
+      if cmd := (&ReplicationCommand{session: s}); cmd.parse(line) && s.mayAdminister() {
+        cmd.Exec()
+      }
+    case "shutdown":
+      if cmd := (&ShutdownCommand{session: s}); cmd.parse(line) && s.mayAdminister() {
+        cmd.Exec()
+      }
+    case "version", "quit":
 
     default:
       Error(s, UnkownCommand, "")
     }
+    observeCommand(line[0], start)
+    if !s.end() {
+      return
+    }
+  }
+}
+
+/* replicas only take writes from their leader and a process being upgraded
+   leaves them to the new one, tell the client otherwise */
+func (s *Session) writable() bool {
+  if follower.readOnly() {
+    return Error(s, ServerError, "read only replica")
+  } else if handingOff() {
+    return Error(s, ServerError, "upgrading")
   }
+  return true
 }
 
 ////////////////////////////// ERROR COMMANDS //////////////////////////////
@@ -118,14 +224,179 @@ func Error(s *Session, errtype int, errdesc string) bool {
   case ServerError:   msg = "SERVER_ERROR " + errdesc + "\r\n"
   }
  // logger.Println(msg)
-  s.conn.Write([]byte(msg))
+  s.writer.Write([]byte(msg))
   return false
 }
 
+/////////////////////////// ARITHMETIC COMMANDS ///////////////////////////
+
+func (self *ArithmeticCommand) parse(line []string) bool {
+  var value uint64
+  var err os.Error
+  if len(line) < 3 {
+    return Error(self.session, ClientError, "Bad arithmetic command: missing parameters")
+  } else if value, err = strconv.Atoui64(line[2]); err != nil {
+    return Error(self.session, ClientError, "invalid numeric delta argument")
+  }
+  self.command = line[0]
+  self.key = line[1]
+  self.value = value
+  if line[len(line)-1] == "noreply" {
+    self.noreply = true
+  }
+  return true
+}
+
+func (self *ArithmeticCommand) Exec() {
+  var storage = self.session.storage
+  var writer = self.session.writer
+  err, _, result := storage.Incr(self.key, self.value, self.command == "incr")
+  if self.command == "incr" {
+    serverStats.hit(&serverStats.incrHits, &serverStats.incrMisses, err == Ok)
+  } else {
+    serverStats.hit(&serverStats.decrHits, &serverStats.decrMisses, err == Ok)
+  }
+  if self.noreply {
+    return
+  }
+  switch err {
+  case Ok:
+    writer.Write([]byte(string(result.content) + "\r\n"))
+  case KeyNotFound:
+    writer.Write([]byte("NOT_FOUND\r\n"))
+  case IllegalParameter:
+    Error(self.session, ClientError, "cannot increment or decrement non-numeric value")
+  }
+}
+
+///////////////////////////// FLUSH COMMAND //////////////////////////////
+
+func (self *FlushCommand) parse(line []string) bool {
+  if line[len(line)-1] == "noreply" {
+    self.noreply = true
+    line = line[:len(line)-1]
+  }
+  if len(line) > 1 {
+    if delay, err := strconv.Atoui64(line[1]); err != nil {
+      return Error(self.session, ClientError, "Bad flush_all command: bad delay")
+    } else {
+      self.exptime = absoluteExptime(delay)
+    }
+  }
+  return true
+}
+
+/* a flush_all with a delay is scheduled once, here, and the storages only
+   ever flush right away. That way every layer drops the items at the same
+   point and the journal and followers see the flush when it happens. A new
+   flush_all overrides a pending delayed one */
+var flushSchedule struct {
+  lock     sync.Mutex
+  deadline uint32
+}
+
+func flushAll(storage CacheStorage, exptime uint32) {
+  flushSchedule.lock.Lock()
+  defer flushSchedule.lock.Unlock()
+  now := uint32(time.Seconds())
+  if exptime <= now {
+    flushSchedule.deadline = 0
+    storage.Flush()
+    return
+  }
+  flushSchedule.deadline = exptime
+  time.AfterFunc(int64(exptime - now) * 1e9, func() {
+    flushSchedule.lock.Lock()
+    defer flushSchedule.lock.Unlock()
+    if flushSchedule.deadline == exptime {
+      flushSchedule.deadline = 0
+      storage.Flush()
+    }
+  })
+}
+
+func (self *FlushCommand) Exec() {
+  atomic.AddUint64(&serverStats.cmdFlush, 1)
+  flushAll(self.session.storage, self.exptime)
+  if !self.noreply {
+    self.session.writer.Write([]byte("OK\r\n"))
+  }
+}
+
+//////////////////////////// SHUTDOWN COMMAND ////////////////////////////
+
+func (self *ShutdownCommand) parse(line []string) bool {
+  if !shutdownEnabled {
+    self.session.writer.Write([]byte("ERROR: shutdown not enabled\r\n"))
+    return false
+  }
+  return true
+}
+
+/* stop accepting connections, this session is drained like any other */
+func (self *ShutdownCommand) Exec() {
+  self.session.writer.Write([]byte("OK\r\n"))
+  connections.stopAccepting()
+}
+
+////////////////////////// REPLICATION COMMAND ///////////////////////////
+
+func (self *ReplicationCommand) parse(line []string) bool {
+  if len(line) != 2 || line[1] != "promote" {
+    return Error(self.session, ClientError, "Bad replication command: expected promote")
+  }
+  self.action = line[1]
+  return true
+}
+
+func (self *ReplicationCommand) Exec() {
+  if follower == nil || !follower.Promote() {
+    Error(self.session, ClientError, "not following a leader")
+  } else {
+    self.session.writer.Write([]byte("OK\r\n"))
+  }
+}
+
+///////////////////////////// STATS COMMAND //////////////////////////////
+
+func (self *StatsCommand) parse(line []string) bool {
+  self.args = line[1:]
+  return true
+}
+
+func (self *StatsCommand) Exec() {
+  var writer = self.session.writer
+  var stats []Stat
+  switch {
+  case len(self.args) == 0:
+    stats = serverStats.general()
+  case self.args[0] == "slabs" && slabAllocator != nil:
+    stats = slabAllocator.slabStats()
+  case self.args[0] == "items" && slabAllocator != nil:
+    stats = slabAllocator.itemStats()
+  default:
+    Error(self.session, UnkownCommand, "")
+    return
+  }
+  for _, stat := range stats {
+    writer.Write([]byte("STAT " + stat.name + " " + stat.value + "\r\n"))
+  }
+  writer.Write([]byte("END\r\n"))
+}
+
 ///////////////////////////// TOUCH COMMAND //////////////////////////////
 
 const secondsInMonth = 60*60*24*30
 
+/* expiration times up to 30 days are relative to now, larger ones are
+   absolute unix times. 0 means never */
+func absoluteExptime(exptime uint64) uint32 {
+  if exptime == 0 || exptime > secondsInMonth {
+    return uint32(exptime)
+  }
+  return uint32(time.Seconds()) + uint32(exptime)
+}
+
 func (self *TouchCommand) parse(line []string) bool {
   var exptime uint64
   var err os.Error
@@ -136,11 +407,7 @@ func (self *TouchCommand) parse(line []string) bool {
   }
   self.command = line[0]
   self.key = line[1]
-  if exptime < secondsInMonth {
-    self.exptime = uint32(time.Seconds()) + uint32(exptime);
-  } else {
-    self.exptime = uint32(exptime)
-  }
+  self.exptime = absoluteExptime(exptime)
   if line[len(line)-1] == "noreply" {
     self.noreply = true
   }
@@ -148,8 +415,14 @@ func (self *TouchCommand) parse(line []string) bool {
 }
 
 func (self *TouchCommand) Exec() {
-  logger.Printf("Touch: command: %s, key: %s, , exptime %d, noreply: %t",
-                self.command, self.key, self.exptime, self.noreply)
+  atomic.AddUint64(&serverStats.cmdTouch, 1)
+  err, _, _ := self.session.storage.Touch(self.key, self.exptime)
+  serverStats.hit(&serverStats.touchHits, &serverStats.touchMisses, err == Ok)
+  if err != Ok && !self.noreply {
+    self.session.writer.Write([]byte("NOT_FOUND\r\n"))
+  } else if err == Ok && !self.noreply {
+    self.session.writer.Write([]byte("TOUCHED\r\n"))
+  }
 }
 
 ///////////////////////////// DELETE COMMAND ////////////////////////////
@@ -170,11 +443,13 @@ func (self *DeleteCommand) Exec() {
 //  logger.Printf("Delete: command: %s, key: %s, noreply: %t",
 //                self.command, self.key, self.noreply)
   var storage = self.session.storage
-  var conn = self.session.conn
-  if err, _ := storage.Delete(self.key) ; err != Ok && !self.noreply {
-    conn.Write([]byte("NOT_FOUND\r\n"))
+  var writer = self.session.writer
+  err, _ := storage.Delete(self.key)
+  serverStats.hit(&serverStats.deleteHits, &serverStats.deleteMisses, err == Ok)
+  if err != Ok && !self.noreply {
+    writer.Write([]byte("NOT_FOUND\r\n"))
   } else if (err == Ok && !self.noreply) {
-    conn.Write([]byte("DELETED\r\n"))
+    writer.Write([]byte("DELETED\r\n"))
   }
 }
 
@@ -186,6 +461,17 @@ func (self *RetrievalCommand) parse(line []string) bool {
   }
   self.command = line[0]
   self.keys = line[1:]
+  if self.command == "gat" || self.command == "gats" {
+    // gat <exptime> <key>*
+    if len(line) < 3 {
+      return Error(self.session, ClientError, "Bad retrieval command: missing parameters")
+    } else if exptime, err := strconv.Atoui64(line[1]); err != nil {
+      return Error(self.session, ClientError, "Bad retrieval command: bad expiration time")
+    } else {
+      self.exptime = absoluteExptime(exptime)
+    }
+    self.keys = line[2:]
+  }
   return true
 }
 
@@ -193,20 +479,30 @@ func (self *RetrievalCommand) Exec() {
 //  logger.Printf("Retrieval: command: %s, keys: %s",
 //                self.command, self.keys)
   var storage = self.session.storage
-  var conn = self.session.conn
-  showAll := self.command == "gets"
+  var writer = self.session.writer
+  showAll := self.command == "gets" || self.command == "gats"
+  touch := self.command == "gat" || self.command == "gats"
   for i := 0; i < len(self.keys); i++ {
-    if err, entry := storage.Get(self.keys[i]); err == Ok {
+    if touch {
+      err, _, _ := storage.Touch(self.keys[i], self.exptime)
+      atomic.AddUint64(&serverStats.cmdTouch, 1)
+      serverStats.hit(&serverStats.touchHits, &serverStats.touchMisses, err == Ok)
+    }
+    err, entry := storage.Get(self.keys[i])
+    atomic.AddUint64(&serverStats.cmdGet, 1)
+    serverStats.hit(&serverStats.getHits, &serverStats.getMisses, err == Ok)
+    if err == Ok {
       if showAll {
-        conn.Write([]byte(fmt.Sprintf("VALUE %s %d %d %d\r\n", self.keys[i], entry.flags, entry.bytes, entry.cas_unique)))
+        writer.Write([]byte(fmt.Sprintf("VALUE %s %d %d %d\r\n", self.keys[i], entry.flags, entry.bytes, entry.cas_unique)))
       } else {
-        conn.Write([]byte(fmt.Sprintf("VALUE %s %d %d\r\n", self.keys[i], entry.flags, entry.bytes)))
+        writer.Write([]byte(fmt.Sprintf("VALUE %s %d %d\r\n", self.keys[i], entry.flags, entry.bytes)))
       }
-      conn.Write(entry.content)
-      conn.Write([]byte("\r\n"))
+      self.session.writeValue(entry.content)
+      writer.Write([]byte("\r\n"))
+      entry.release()
     }
   }
-  conn.Write([]byte("END\r\n"))
+  writer.Write([]byte("END\r\n"))
 }
 
 ///////////////////////////// STORAGE COMMANDS /////////////////////////////
@@ -224,6 +520,8 @@ func (self *StorageCommand) parse(line []string) bool {
     return Error(self.session, ClientError, "Bad storage command: bad expiration time")
   } else if bytes, err = strconv.Atoui64(line[4]); err != nil {
     return Error(self.session, ClientError, "Bad storage command: bad byte-length")
+  } else if !fitsItemSize(self.session, bytes) {
+    return false
   } else if line[0] == "cas" {
     if casuniq, err = strconv.Atoui64(line[5]); err != nil {
       return Error(self.session, ClientError, "Bad storage command: bad cas value")
@@ -232,11 +530,7 @@ func (self *StorageCommand) parse(line []string) bool {
   self.command = line[0]
   self.key = line[1]
   self.flags = uint32(flags)
-  if exptime == 0 || exptime > secondsInMonth {
-    self.exptime = uint32(exptime)
-  } else {
-    self.exptime = uint32(time.Seconds()) + uint32(exptime);
-  }
+  self.exptime = absoluteExptime(exptime)
   self.bytes = uint32(bytes)
   self.cas_unique = casuniq
   if line[len(line)-1] == "noreply" {
@@ -249,23 +543,43 @@ func (self *StorageCommand) parse(line []string) bool {
 func (self *StorageCommand) readData() bool {
   if self.bytes <= 0 {
     return Error(self.session, ClientError, "Bad storage operation: trying to read 0 bytes")
-  } else {
-    self.data = make([]byte, self.bytes + 2) // \r\n is always present at the end
   }
-  var reader = self.session.bufreader
-  // read all the data
-  for offset := 0; offset < int(self.bytes); {
-    if nread, err := reader.Read(self.data[offset:]); err != nil {
-      return Error(self.session, ServerError, "Failed to read data")
-    } else {
-      offset += nread
+  var ok bool
+  self.data, ok = readDataBlock(self.session, self.bytes)
+  return ok
+}
+
+/* data blocks up to this size keep their buffer for the next one */
+const maxDataBuffer = 64 * 1024
+
+/* whether a data block of the given length may be stored. A larger one is
+   read off the connection and refused before any memory is set aside */
+func fitsItemSize(s *Session, bytes uint64) bool {
+  if bytes <= uint64(maxItemSize) {
+    return true
+  }
+  io.Copyn(ioutil.Discard, s.bufreader, int64(bytes) + 2)
+  return Error(s, ServerError, "object too large for cache")
+}
+
+/* read a data block of the given length terminated by \r\n. The block is
+   only valid until the next one is read */
+func readDataBlock(s *Session, bytes uint32) ([]byte, bool) {
+  buffer := s.databuf
+  if cap(buffer) < int(bytes) + 2 {
+    buffer = make([]byte, bytes + 2)
+    if len(buffer) <= maxDataBuffer {
+      s.databuf = buffer
     }
   }
-  if string(self.data[len(self.data)-2:]) != "\r\n" {
-    return Error(self.session, ClientError, "Bad storage operation: bad data chunk")
+  data := buffer[:bytes + 2] // \r\n is always present at the end
+  if _, err := io.ReadFull(s.bufreader, data); err != nil {
+    return nil, Error(s, ServerError, "Failed to read data")
   }
-  self.data = self.data[:len(self.data)-2] // strip \n\r
-  return true
+  if string(data[len(data)-2:]) != "\r\n" {
+    return nil, Error(s, ClientError, "Bad storage operation: bad data chunk")
+  }
+  return data[:len(data)-2], true // strip \n\r
 }
 
 func (self *StorageCommand) Exec() {
@@ -275,49 +589,455 @@ func (self *StorageCommand) Exec() {
                 self.cas_unique, self.noreply, string(self.data))
 */
   var storage = self.session.storage
-  var conn = self.session.conn
+  var writer = self.session.writer
+  atomic.AddUint64(&serverStats.cmdSet, 1)
 
   switch self.command {
 
   case "set":
     storage.Set(self.key, self.flags, self.exptime, self.bytes, self.data)
     if !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      writer.Write([]byte("STORED\r\n"))
     }
     return
   case "add":
     if err, _ := storage.Add(self.key, self.flags, self.exptime, self.bytes, self.data); err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+      writer.Write([]byte("NOT_STORED\r\n"))
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      writer.Write([]byte("STORED\r\n"))
     }
   case "replace":
     if err, _, _ := storage.Replace(self.key, self.flags, self.exptime, self.bytes, self.data) ; err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+      writer.Write([]byte("NOT_STORED\r\n"))
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      writer.Write([]byte("STORED\r\n"))
     }
   case "append":
     if err, _, _ := storage.Append(self.key, self.bytes, self.data) ; err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+      writer.Write([]byte("NOT_STORED\r\n"))
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      writer.Write([]byte("STORED\r\n"))
     }
   case "prepend":
     if err, _, _ := storage.Prepend(self.key, self.bytes, self.data) ; err != Ok && !self.noreply {
-      conn.Write([]byte("NOT_STORED\r\n"))
+      writer.Write([]byte("NOT_STORED\r\n"))
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      writer.Write([]byte("STORED\r\n"))
     }
   case "cas":
-    if err, prev, _ := storage.Cas(self.key, self.flags, self.exptime, self.bytes, self.cas_unique, self.data) ; err != Ok && !self.noreply {
+    err, prev, _ := storage.Cas(self.key, self.flags, self.exptime, self.bytes, self.cas_unique, self.data)
+    if err == Ok {
+      atomic.AddUint64(&serverStats.casHits, 1)
+    } else if prev != nil {
+      atomic.AddUint64(&serverStats.casBadval, 1)
+    } else {
+      atomic.AddUint64(&serverStats.casMisses, 1)
+    }
+    if err != Ok && !self.noreply {
       if prev != nil {
-        conn.Write([]byte("EXISTS\r\n"))
+        writer.Write([]byte("EXISTS\r\n"))
       } else {
-        conn.Write([]byte("NOT_STORED\r\n"))
+        writer.Write([]byte("NOT_STORED\r\n"))
       }
     } else if err == Ok && !self.noreply {
-      conn.Write([]byte("STORED\r\n"))
+      writer.Write([]byte("STORED\r\n"))
+    }
+  }
+}
+
+/////////////////////////////// META COMMANDS //////////////////////////////
+
+/* parse a meta command: <cmd> <key> [<datalen>] <flag>* and read the data
+   block for ms. Flags are a single character optionally followed by a token */
+func (self *MetaCommand) parse(line []string) bool {
+  self.command = line[0]
+  if self.command == "mn" {
+    return true
+  }
+  if len(line) < 2 {
+    return Error(self.session, ClientError, "bad command line format")
+  }
+  self.rawKey = line[1]
+  self.key = line[1]
+  self.flags = line[2:]
+  if self.command == "ms" {
+    if len(line) < 3 {
+      return Error(self.session, ClientError, "bad command line format")
+    } else if datalen, err := strconv.Atoui64(line[2]); err != nil {
+      return Error(self.session, ClientError, "bad data chunk")
+    } else if !fitsItemSize(self.session, datalen) {
+      return false
+    } else {
+      self.datalen = uint32(datalen)
+    }
+    self.flags = line[3:]
+  }
+  if self.command == "ms" {
+    // read even when the key turns out bad, it would be taken for a command
+    var ok bool
+    if self.data, ok = readDataBlock(self.session, self.datalen); !ok {
+      return false
+    }
+  }
+  if self.has('b') {
+    if key, err := base64.StdEncoding.DecodeString(self.rawKey); err != nil {
+      return Error(self.session, ClientError, "bad key encoding")
+    } else {
+      self.key = string(key)
+    }
+  }
+  return true
+}
+
+/* whether entries keep their stale and win token state, not the case of
+   the legacy storages */
+var metaStateKept = true
+
+/* invalidation and win tokens need the state entries keep */
+func (self *MetaCommand) supported() bool {
+  if !metaStateKept && (self.has('I') || self.has('N') || self.has('R')) {
+    return Error(self.session, ClientError, "invalidation not supported by this storage")
+  }
+  return true
+}
+
+/* whether a meta get changes the item, with T or N */
+func (self *MetaCommand) writes() bool {
+  return self.command == "mg" && (self.has('T') || self.has('N'))
+}
+
+/* look up a flag and return its token */
+func (self *MetaCommand) flag(name byte) (string, bool) {
+  for _, f := range self.flags {
+    if f[0] == name {
+      return f[1:], true
+    }
+  }
+  return "", false
+}
+
+func (self *MetaCommand) has(name byte) bool {
+  _, present := self.flag(name)
+  return present
+}
+
+/* look up a numeric flag, returning def if it's missing and false if its
+   token can't be parsed */
+func (self *MetaCommand) numericFlag(name byte, def uint64) (uint64, bool) {
+  token, present := self.flag(name)
+  if !present {
+    return def, true
+  }
+  value, err := strconv.Atoui64(token)
+  return value, err == nil
+}
+
+/* build the flags returned to the client, in the order they were requested */
+func (self *MetaCommand) returnFlags(entry *StorageEntry) string {
+  var ret string
+  for _, f := range self.flags {
+    switch f[0] {
+    case 'O':
+      ret += " " + f
+    case 'k':
+      ret += " k" + self.rawKey
+    case 'b':
+      if self.has('k') {
+        ret += " b"
+      }
+    }
+    if entry == nil {
+      continue
+    }
+    switch f[0] {
+    case 'c':
+      ret += " c" + strconv.Uitoa64(entry.cas_unique)
+    case 'f':
+      ret += " f" + strconv.Uitoa64(uint64(entry.flags))
+    case 'h':
+      if entry.wasFetched {
+        ret += " h1"
+      } else {
+        ret += " h0"
+      }
+    case 'l':
+      ret += " l" + strconv.Itoa64(time.Seconds() - int64(entry.prevAccess))
+    case 's':
+      ret += " s" + strconv.Uitoa64(uint64(entry.bytes))
+    case 't':
+      ret += " t" + strconv.Itoa64(entry.ttl())
+    }
+  }
+  return ret
+}
+
+/* write a status line unless it's the kind quiet mode suppresses */
+func (self *MetaCommand) reply(code string, entry *StorageEntry, quietable bool) {
+  if quietable && self.has('q') {
+    return
+  }
+  self.session.writer.Write([]byte(code + self.returnFlags(entry) + "\r\n"))
+}
+
+/* write the value line and data block of an entry */
+func (self *MetaCommand) replyValue(entry *StorageEntry, extra string) {
+  var writer = self.session.writer
+  writer.Write([]byte("VA " + strconv.Uitoa64(uint64(entry.bytes)) + self.returnFlags(entry) + extra + "\r\n"))
+  self.session.writeValue(entry.content)
+  writer.Write([]byte("\r\n"))
+}
+
+func (self *MetaCommand) Exec() {
+  switch self.command {
+  case "mg":
+    self.metaGet()
+  case "ms":
+    self.metaSet()
+  case "md":
+    self.metaDelete()
+  case "ma":
+    self.metaArithmetic()
+  case "me":
+    self.metaDebug()
+  case "mn":
+    self.session.writer.Write([]byte("MN\r\n"))
+  }
+}
+
+func (self *MetaCommand) metaGet() {
+  var storage = self.session.storage
+  vivifyTtl, okVivify := self.numericFlag('N', 0)
+  if !okVivify {
+    Error(self.session, ClientError, "bad token in command line format")
+    return
+  }
+  if ttl, present := self.flag('T'); present {
+    exptime, err := strconv.Atoui64(ttl)
+    if err != nil {
+      Error(self.session, ClientError, "bad token in command line format")
+      return
     }
+    err2, _, _ := storage.Touch(self.key, absoluteExptime(exptime))
+    atomic.AddUint64(&serverStats.cmdTouch, 1)
+    serverStats.hit(&serverStats.touchHits, &serverStats.touchMisses, err2 == Ok)
+  }
+  err, entry := storage.Get(self.key)
+  vivified := false
+  if err != Ok && self.has('N') {
+    // vivify on miss: create an empty item and hand this client the win token
+    // so it's the only one recaching it
+    addErr, _ := storage.Add(self.key, 0, absoluteExptime(vivifyTtl), 0, []byte{})
+    vivified = addErr == Ok
+    err, entry = storage.Get(self.key)
+  }
+  atomic.AddUint64(&serverStats.cmdGet, 1)
+  serverStats.hit(&serverStats.getHits, &serverStats.getMisses, err == Ok)
+  if err != Ok {
+    self.reply("EN", nil, true)
+    return
+  }
+  defer entry.release()
+  won := vivified && entry.claimWin()
+
+  // stale items and items about to expire (R flag) hand out a single win
+  // token, everybody else is told someone is already recaching the value
+  stale := entry.isStale()
+  if !won && stale {
+    won = entry.claimWin()
+  } else if token, present := self.flag('R'); !won && present && entry.exptime != 0 {
+    if recache, err := strconv.Atoi64(token); err == nil && entry.ttl() < recache {
+      won = entry.claimWin()
+    }
+  }
+  var extra string
+  if won {
+    extra += " W"
+  }
+  if stale {
+    extra += " X"
+  }
+  if !won && entry.winClaimed() {
+    extra += " Z"
+  }
+
+  if self.has('v') {
+    self.replyValue(entry, extra)
+  } else {
+    self.session.writer.Write([]byte("HD" + self.returnFlags(entry) + extra + "\r\n"))
+  }
+}
+
+func (self *MetaCommand) metaSet() {
+  var storage = self.session.storage
+  atomic.AddUint64(&serverStats.cmdSet, 1)
+  flags, okFlags := self.numericFlag('F', 0)
+  ttl, okTtl := self.numericFlag('T', 0)
+  cas, okCas := self.numericFlag('C', 0)
+  if !okFlags || !okTtl || !okCas {
+    Error(self.session, ClientError, "bad token in command line format")
+    return
+  }
+  exptime := absoluteExptime(ttl)
+  mode, _ := self.flag('M')
+  compare := self.has('C')
+
+  var err ErrorCode = Ok
+  var prev, entry *StorageEntry
+  switch mode {
+  case "", "S", "s":
+    if compare {
+      err, prev, entry = storage.Cas(self.key, uint32(flags), exptime, self.datalen, cas, self.data)
+      // with invalidation an outdated cas still stores the item, marked stale
+      if err == IllegalParameter && self.has('I') && prev.cas_unique > cas {
+        prev, entry = storage.Set(self.key, uint32(flags), exptime, self.datalen, self.data)
+        entry.markStale()
+        err = Ok
+      }
+    } else {
+      prev, entry = storage.Set(self.key, uint32(flags), exptime, self.datalen, self.data)
+    }
+  case "E", "e":
+    err, entry = storage.Add(self.key, uint32(flags), exptime, self.datalen, self.data)
+  case "A", "a":
+    err, prev, entry = storage.Append(self.key, self.datalen, self.data)
+  case "P", "p":
+    err, prev, entry = storage.Prepend(self.key, self.datalen, self.data)
+  case "R", "r":
+    if compare {
+      err, prev, entry = storage.Cas(self.key, uint32(flags), exptime, self.datalen, cas, self.data)
+    } else {
+      err, prev, entry = storage.Replace(self.key, uint32(flags), exptime, self.datalen, self.data)
+    }
+  default:
+    Error(self.session, ClientError, "invalid mode for ms")
+    return
+  }
+
+  switch {
+  case err == Ok:
+    self.reply("HD", entry, true)
+  case compare && err == IllegalParameter:
+    self.reply("EX", nil, false)
+  case compare && err == KeyNotFound:
+    self.reply("NF", nil, false)
+  default:
+    self.reply("NS", nil, false)
+  }
+}
+
+func (self *MetaCommand) metaDelete() {
+  var storage = self.session.storage
+  cas, okCas := self.numericFlag('C', 0)
+  ttl, okTtl := self.numericFlag('T', 0)
+  if !okCas || !okTtl {
+    Error(self.session, ClientError, "bad token in command line format")
+    return
+  }
+  err, entry := storage.Get(self.key)
+  if err == Ok {
+    entry.release()
+  }
+  if err == Ok && self.has('C') && entry.cas_unique != cas {
+    self.reply("EX", nil, false)
+    return
+  }
+  if err == Ok && self.has('I') {
+    // invalidate: keep serving the item, but as stale
+    if self.has('T') {
+      if err2, _, touched := storage.Touch(self.key, absoluteExptime(ttl)); err2 == Ok {
+        entry = touched
+      }
+    }
+    entry.markStale()
+  } else if err == Ok {
+    err, _ = storage.Delete(self.key)
+  }
+  serverStats.hit(&serverStats.deleteHits, &serverStats.deleteMisses, err == Ok)
+  if err != Ok {
+    self.reply("NF", nil, false)
+  } else {
+    self.reply("HD", nil, true)
+  }
+}
+
+func (self *MetaCommand) metaArithmetic() {
+  var storage = self.session.storage
+  delta, okDelta := self.numericFlag('D', 1)
+  initial, okInitial := self.numericFlag('J', 0)
+  cas, okCas := self.numericFlag('C', 0)
+  vivifyTtl, okVivify := self.numericFlag('N', 0)
+  if !okDelta || !okInitial || !okCas || !okVivify {
+    Error(self.session, ClientError, "bad token in command line format")
+    return
+  }
+  incr := true
+  switch mode, _ := self.flag('M'); mode {
+  case "", "I", "i", "+":
+  case "D", "d", "-":
+    incr = false
+  default:
+    Error(self.session, ClientError, "invalid mode for ma")
+    return
+  }
+  if self.has('C') {
+    if err, current := storage.Get(self.key); err == Ok {
+      current.release()
+      if current.cas_unique != cas {
+        self.reply("EX", nil, false)
+        return
+      }
+    }
+  }
+
+  err, _, entry := storage.Incr(self.key, delta, incr)
+  if err == KeyNotFound && self.has('N') {
+    // auto vivify the counter with the initial value
+    content := []byte(strconv.Uitoa64(initial))
+    if err, entry = storage.Add(self.key, 0, absoluteExptime(vivifyTtl), uint32(len(content)), content); err != Ok {
+      err, _, entry = storage.Incr(self.key, delta, incr)
+    }
+  }
+  if incr {
+    serverStats.hit(&serverStats.incrHits, &serverStats.incrMisses, err == Ok)
+  } else {
+    serverStats.hit(&serverStats.decrHits, &serverStats.decrMisses, err == Ok)
+  }
+
+  switch err {
+  case KeyNotFound:
+    self.reply("NF", nil, false)
+  case IllegalParameter:
+    Error(self.session, ClientError, "cannot increment or decrement non-numeric value")
+  case Ok:
+    if token, present := self.flag('T'); present {
+      if ttl, err := strconv.Atoui64(token); err == nil {
+        if err2, _, touched := storage.Touch(self.key, absoluteExptime(ttl)); err2 == Ok {
+          entry = touched
+        }
+      }
+    }
+    if !self.has('v') {
+      self.reply("HD", entry, true)
+    } else if err, current := storage.Get(self.key); err == Ok {
+      self.replyValue(current, "")
+      current.release()
+    } else {
+      self.reply("NF", nil, false)
+    }
+  }
+}
+
+func (self *MetaCommand) metaDebug() {
+  err, entry := self.session.storage.Get(self.key)
+  if err != Ok {
+    self.session.writer.Write([]byte("EN\r\n"))
+    return
+  }
+  entry.release()
+  fetched := "no"
+  if entry.wasFetched {
+    fetched = "yes"
   }
+  self.session.writer.Write([]byte(fmt.Sprintf("ME %s exp=%d la=%d cas=%d fetch=%s cls=1 size=%d\r\n",
+    self.rawKey, entry.ttl(), time.Seconds() - int64(entry.prevAccess), entry.cas_unique, fetched, entry.bytes)))
 }
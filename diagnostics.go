@@ -0,0 +1,121 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "http"
+  "time"
+  "runtime"
+  "runtime/pprof"
+  httpprof "http/pprof"
+)
+
+/* Diagnostics served on -diagnostics-addr:
+
+   /debug/pprof/profile?seconds=N  cpu profile, 30 seconds by default
+   /debug/pprof/heap               heap profile
+   /debug/pprof/goroutine          stack traces of every goroutine
+   /debug/pprof/cmdline            command line
+   /debug/pprof/symbol             symbol lookup for pprof
+   /debug/gc                       memory and garbage collector statistics
+   /debug/heapdump                 POST to write a heap profile to the dump directory
+
+   Profiles are read with gopprof gocached http://addr/debug/pprof/heap
+
+   Blocking and mutex contention profiles are not supported in this build,
+   the Go release it is built with records neither. /debug/pprof/block and
+   /debug/pprof/mutex answer 501 Not Implemented saying so */
+
+func serveDiagnostics(addr string, dumpDir string) {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/debug/pprof/", pprofIndex)
+  mux.HandleFunc("/debug/pprof/profile", httpprof.Profile)
+  mux.HandleFunc("/debug/pprof/heap", httpprof.Heap)
+  mux.HandleFunc("/debug/pprof/goroutine", goroutineDump)
+  mux.HandleFunc("/debug/pprof/block", unsupportedProfile)
+  mux.HandleFunc("/debug/pprof/mutex", unsupportedProfile)
+  mux.HandleFunc("/debug/pprof/cmdline", httpprof.Cmdline)
+  mux.HandleFunc("/debug/pprof/symbol", httpprof.Symbol)
+  mux.HandleFunc("/debug/gc", gcStats)
+  mux.HandleFunc("/debug/heapdump", heapDumpHandler(dumpDir))
+  logger.Printf("Serving diagnostics on %s", addr)
+  listener, err := listenRetrying("tcp", addr)
+  if err != nil {
+    logger.Fatalf("Unable to serve diagnostics on %s: %s", addr, err)
+  }
+  http.Serve(listener, mux)
+}
+
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  for _, name := range []string{"profile", "heap", "goroutine", "cmdline", "symbol"} {
+    fmt.Fprintf(w, "/debug/pprof/%s\n", name)
+  }
+  fmt.Fprintf(w, "/debug/gc\n/debug/heapdump\n")
+}
+
+func goroutineDump(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  // grow the buffer until every stack fits
+  buf := make([]byte, 1 << 16)
+  for {
+    n := runtime.Stack(buf, true)
+    if n < len(buf) {
+      fmt.Fprintf(w, "%d goroutines\n\n", runtime.NumGoroutine())
+      w.Write(buf[:n])
+      return
+    }
+    buf = make([]byte, 2 * len(buf))
+  }
+}
+
+func unsupportedProfile(w http.ResponseWriter, r *http.Request) {
+  http.Error(w, "blocking and mutex profiles are not supported in this build", http.StatusNotImplemented)
+}
+
+/* dumps are written to disk, a stray GET such as a crawler's mustn't fill it */
+func heapDumpHandler(dumpDir string) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+      w.Header().Set("Allow", "POST")
+      http.Error(w, "heap dumps are requested with POST", http.StatusMethodNotAllowed)
+    } else if path, err := dumpHeap(dumpDir); err != nil {
+      http.Error(w, err.String(), http.StatusInternalServerError)
+    } else {
+      fmt.Fprintf(w, "%s\n", path)
+    }
+  }
+}
+
+func gcStats(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  runtime.UpdateMemStats()
+  stats := runtime.MemStats
+  fmt.Fprintf(w, "goroutines %d\n", runtime.NumGoroutine())
+  fmt.Fprintf(w, "alloc %d\ntotal_alloc %d\nsys %d\n", stats.Alloc, stats.TotalAlloc, stats.Sys)
+  fmt.Fprintf(w, "mallocs %d\nfrees %d\n", stats.Mallocs, stats.Frees)
+  fmt.Fprintf(w, "heap_alloc %d\nheap_sys %d\nheap_idle %d\nheap_inuse %d\nheap_objects %d\n",
+              stats.HeapAlloc, stats.HeapSys, stats.HeapIdle, stats.HeapInuse, stats.HeapObjects)
+  fmt.Fprintf(w, "next_gc %d\nnum_gc %d\npause_total_ns %d\n", stats.NextGC, stats.NumGC, stats.PauseTotalNs)
+  // the most recent pauses first
+  fmt.Fprintf(w, "recent_pauses_ns")
+  for i := uint32(0); i < stats.NumGC && i < 16; i++ {
+    fmt.Fprintf(w, " %d", stats.PauseNs[(stats.NumGC - 1 - i) % uint32(len(stats.PauseNs))])
+  }
+  fmt.Fprintf(w, "\n")
+}
+
+/* write a heap profile to a new file in dir, returns its path */
+func dumpHeap(dir string) (string, os.Error) {
+  path := fmt.Sprintf("%s/gocached-heap-%d-%d.prof", dir, os.Getpid(), time.Nanoseconds())
+  file, err := os.Create(path)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+  if err = pprof.WriteHeapProfile(file); err != nil {
+    return "", err
+  }
+  logger.Printf("Wrote heap profile to %s", path)
+  return path, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+  "os"
+  "http"
+  "strings"
+  "testing"
+  "http/httptest"
+)
+
+func TestGCStats(t *testing.T) {
+
+  request, _ := http.NewRequest("GET", "/debug/gc", nil)
+  recorder := httptest.NewRecorder()
+  gcStats(recorder, request)
+  stats := recorder.Body.String()
+
+  for _, field := range []string{"goroutines ", "heap_alloc ", "num_gc ", "pause_total_ns ", "recent_pauses_ns"} {
+    assertEquals(t, strings.Contains(stats, "\n" + field) || strings.HasPrefix(stats, field), true, field + "not reported")
+  }
+}
+
+func TestDumpHeap(t *testing.T) {
+
+  path, err := dumpHeap(os.TempDir())
+  assertEquals(t, err == nil, true, "heap not dumped")
+  defer os.Remove(path)
+  info, err := os.Stat(path)
+  assertEquals(t, err == nil && info.Size > 0, true, "empty heap dump")
+
+  _, err = dumpHeap(os.TempDir() + "/gocached-missing-dir")
+  assertEquals(t, err != nil, true, "heap dumped to a missing directory")
+}
+
+func TestHeapDumpNeedsPost(t *testing.T) {
+
+  handler := heapDumpHandler(os.TempDir())
+  request, _ := http.NewRequest("GET", "/debug/heapdump", nil)
+  recorder := httptest.NewRecorder()
+  handler(recorder, request)
+  assertEquals(t, recorder.Code, http.StatusMethodNotAllowed, "heap dumped on GET")
+
+  request, _ = http.NewRequest("POST", "/debug/heapdump", nil)
+  recorder = httptest.NewRecorder()
+  handler(recorder, request)
+  assertEquals(t, recorder.Code, http.StatusOK, "heap not dumped on POST")
+  os.Remove(strings.TrimSpace(recorder.Body.String()))
+}
@@ -1,8 +1,18 @@
 package main
 
+import (
+  "sync"
+  "time"
+)
+
+/* Tells the generational storage about every change of expiration time.
+   Mutations share the lock a flush takes alone, so the flush message is
+   queued after the messages of the mutations it wiped and before those of
+   the ones that follow it */
 type EventNotifierStorage struct {
   updatesChannel chan UpdateMessage
-  storage CacheStorage
+  storage        CacheStorage
+  lock           sync.RWMutex
 }
 
 type UpdateMessage struct {
@@ -17,6 +27,7 @@ const (
   Add
   Change
   Collect
+  Flush
 )
 
 func updateMessageLogger(updatesChannel chan UpdateMessage) {
@@ -27,10 +38,12 @@ func updateMessageLogger(updatesChannel chan UpdateMessage) {
 }
 
 func newEventNotifierStorage(storage CacheStorage, updatesChannel chan UpdateMessage) *EventNotifierStorage {
-  return &EventNotifierStorage{updatesChannel, storage}
+  return &EventNotifierStorage{updatesChannel: updatesChannel, storage: storage}
 }
 
 func (self *EventNotifierStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (*StorageEntry, *StorageEntry) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
   previous, updated := self.storage.Set(key, flags, exptime, bytes, content)
   if (previous != nil) {
     self.updatesChannel <- UpdateMessage{Change, key, int64(previous.exptime), int64(exptime)}
@@ -41,6 +54,8 @@ func (self *EventNotifierStorage) Set(key string, flags uint32, exptime uint32,
 }
 
 func (self *EventNotifierStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
   err, updatedEntry := self.storage.Add(key, flags, exptime, bytes, content)
   if (err == Ok) {
     self.updatesChannel <- UpdateMessage{Add, key, 0, int64(exptime)}
@@ -49,6 +64,8 @@ func (self *EventNotifierStorage) Add(key string, flags uint32, exptime uint32,
 }
 
 func (self *EventNotifierStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
   err, prev, updated := self.storage.Replace(key, flags, exptime, bytes, content)
   if (err == Ok) {
     self.updatesChannel <- UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)}
@@ -65,6 +82,8 @@ func (self *EventNotifierStorage) Prepend(key string, bytes uint32, content []by
 }
 
 func (self *EventNotifierStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
   err, prev, updated := self.storage.Cas(key, flags, exptime, bytes, cas_unique, content)
   if (err == Ok) {
     self.updatesChannel <- UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)}
@@ -77,6 +96,8 @@ func (self *EventNotifierStorage) Get(key string) (err ErrorCode, result *Storag
 }
 
 func (self *EventNotifierStorage) Delete(key string) (ErrorCode, *StorageEntry) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
   err, deleted := self.storage.Delete(key)
   if (err == Ok) {
     self.updatesChannel <- UpdateMessage{Delete, key, int64(deleted.exptime), 0}
@@ -88,6 +109,27 @@ func (self *EventNotifierStorage) Incr(key string, value uint64, incr bool) (Err
   return self.storage.Incr(key, value, incr)
 }
 
+func (self *EventNotifierStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  err, prev, updated := self.storage.Touch(key, exptime)
+  if (err == Ok) {
+    self.updatesChannel <- UpdateMessage{Change, key, int64(prev.exptime), int64(exptime)}
+  }
+  return err, prev, updated
+}
+
+func (self *EventNotifierStorage) Flush() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.storage.Flush()
+  self.updatesChannel <- UpdateMessage{Flush, "", time.Seconds(), 0}
+}
+
+func (self *EventNotifierStorage) Walk(f func(key string, entry *StorageEntry)) {
+  self.storage.Walk(f)
+}
+
 func (self *EventNotifierStorage) Expire(key string) {
   self.storage.Expire(key)
 }
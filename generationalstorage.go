@@ -3,18 +3,29 @@ package main
 import (
   "time"
   "fmt"
+  "sync"
 )
 
 const (
   GCDelay = 60
   GenerationSize = 60
-  StorageThreshold = 5000
 )
 
-var timer = func(updatesChannel chan UpdateMessage) {
+var timer = func(storage *GenerationalStorage) {
+  defer storage.stopped.Done()
+  ticker := time.NewTicker(1e9 * GCDelay) // one second * GCDelay
+  defer ticker.Stop()
   for {
-    time.Sleep(1e9 * GCDelay) // one second * GCDelay
-    updatesChannel <- UpdateMessage{Collect, "", time.Seconds(), 0}
+    select {
+    case <-ticker.C:
+      select {
+      case storage.updatesChannel <- UpdateMessage{Collect, "", time.Seconds(), 0}:
+      case <-storage.quit:
+        return
+      }
+    case <-storage.quit:
+      return
+    }
   }
 }
 
@@ -53,11 +64,18 @@ type GenerationalStorage struct {
   cacheStorage    CacheStorage
   lastCollected   int64
   items           uint64
+  // held while a message is processed, so stats can be read meanwhile
+  lock            sync.Mutex
+  quit            chan bool
+  stopped         sync.WaitGroup
 }
 
 func newGenerationalStorage(cacheStorage CacheStorage, updatesChannel chan UpdateMessage) *GenerationalStorage {
-  storage := &GenerationalStorage{ make(map [int64] *Generation), updatesChannel, cacheStorage, roundTime(time.Seconds()) - GenerationSize, 0 }
-  go timer(updatesChannel)
+  storage := &GenerationalStorage{generations: make(map [int64] *Generation), updatesChannel: updatesChannel,
+                                  cacheStorage: cacheStorage, lastCollected: roundTime(time.Seconds()) - GenerationSize,
+                                  quit: make(chan bool)}
+  storage.stopped.Add(2)
+  go timer(storage)
   go processNodeChanges(storage, updatesChannel)
   return storage;
 }
@@ -84,14 +102,43 @@ func (self *GenerationalStorage) findGeneration(timeSlot int64, createIfNotExist
   return generation
 }
 
+/* forget about every tracked item, the storage has been flushed */
+func (self *GenerationalStorage) reset() {
+  self.generations = make(map [int64] *Generation)
+  self.items = 0
+}
+
+/* stop the timer and the processing of updates, waiting for both */
+func (self *GenerationalStorage) Stop() {
+  close(self.quit)
+  self.stopped.Wait()
+}
+
+/* the number of generations and of the items waiting in them */
+func (self *GenerationalStorage) stats() (generations int, pending int) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  for _, generation := range self.generations {
+    pending += len(generation.inhabitants)
+  }
+  return len(self.generations), pending
+}
+
 func (self *Generation) addInhabitant(key string) {
   //logger.Printf("Adding key %s to generation %s", key,  time.SecondsToUTC(self.startEpoch))
   self.inhabitants[key] = true
 }
 
 func processNodeChanges(storage *GenerationalStorage, channel <-chan UpdateMessage /*, ticker *time.Ticker*/) {
+  defer storage.stopped.Done()
   for {
-    msg := <-channel
+    var msg UpdateMessage
+    select {
+    case msg = <-channel:
+    case <-storage.quit:
+      return
+    }
+    storage.lock.Lock()
     switch msg.op {
     case Add:
     //  logger.Println("Processing Add message")
@@ -130,16 +177,13 @@ func processNodeChanges(storage *GenerationalStorage, channel <-chan UpdateMessa
           storage.items -= 1
         }
       }
-      if storage.items > StorageThreshold {
-        permGen := storage.findGeneration(GenerationSize, true)
-        storage.generations[GenerationSize] = nil, false
-        for key , _ := range(permGen.inhabitants) {
-          storage.cacheStorage.Expire(key)
-          storage.items -= 1
-        }
-        logger.Printf("Memory pressure. Collecting %d expiring items. %d items on permanent generation", storage.items)
-      }
       logger.Printf("No more items to collect. %d Items", storage.items)
+    case Flush:
+      // sent once the storage is empty, after the messages of the items it
+      // had. Delayed flushes are only sent when they happen
+      logger.Println("Processing Flush message")
+      storage.reset()
     }
+    storage.lock.Unlock()
   }
 }
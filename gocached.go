@@ -5,8 +5,8 @@ import (
 	"os"
 	"log"
 	"net"
+	"strings"
   /*"runtime"*/
-  /*"runtime/pprof"*/
 )
 
 //global logger
@@ -14,86 +14,294 @@ var logger = log.New(os.Stdout, "gocached: ", log.Lshortfile|log.LstdFlags)
 
 
 func main() {
-	var storage CacheStorage
-	var factory CacheStorageFactory
-
   /*runtime.GOMAXPROCS(1)*/
 	// command line flags and parsing
 	var port = flag.String("port", "11212", "memcached port")
-  /*var memprofile = flag.String("memprofile", "", "write memory profile to this file")*/
+	var listen = flag.String("listen", "", "comma separated addresses to listen on, host:port, [ipv6]:port or unix:/path (default 0.0.0.0 on -port)")
+	var udpPort = flag.String("udp-port", "", "udp port to serve requests on, on the hosts of -listen (empty to disable)")
+	var outputBuffer = flag.Int("output-buffer", 16384, "bytes of replies buffered per connection before they are written")
+	var unixMode = flag.String("unix-mode", "0700", "octal file mode of unix domain sockets")
+	var tlsListen = flag.String("tls-listen", "", "comma separated addresses to serve TLS on, in the -listen syntax")
+	var tlsCert = flag.String("tls-cert", "", "PEM certificate file for TLS listeners")
+	var tlsKey = flag.String("tls-key", "", "PEM private key file for TLS listeners")
+	var tlsClientCA = flag.String("tls-client-ca", "", "PEM file of the authorities client certificates must be signed by (empty to not require them)")
+	var saslPasswords = flag.String("sasl-pwdb", "", "file of username:password lines clients must authenticate with (empty to disable)")
+	var aclConfigFile = flag.String("acl-config", "", "json file with the key prefixes each authenticated user may read and write (empty to allow everything)")
+	var tlsCiphers = flag.String("tls-ciphers", "", "comma separated cipher suites to allow (empty for the defaults)")
 
-  //	var storage_choice = flag.String("storage", "generational",
-//		"storage implementation (generational, heap, map)")
-//	var expiring_frequency = flag.Int64("expiring-interval", 10,
-//		"expiring interval in seconds")
+	var storageChoice = flag.String("storage", "generational",
+		"storage implementation (" + strings.Join(storageBackendNames(), ", ") + ")")
+	var expiringInterval = flag.Int64("expiring-interval", 10,
+		"expiring interval in seconds for the heap storage")
 
 var partitions = flag.Int("partitions", 10, "storage partitions (0 or 1 to disable)")
+	var megabytes = flag.Int64("m", 64, "memory limit for items in megabytes (0 for unlimited)")
+	var growthFactor = flag.Float64("f", 1.25, "chunk size growth factor between slab classes")
+	var minChunk = flag.Int("n", 48, "minimum slab chunk size in bytes")
+	var itemSize = flag.String("I", "1m", "largest item accepted, in bytes or with a k or m suffix")
+	var disableCas = flag.Bool("C", false, "disable the use of cas unique values")
+	var rebalanceInterval = flag.Int64("slab-rebalance-interval", 10, "seconds between slab page rebalancing")
+	var snapshotFile = flag.String("snapshot-file", "", "file to save the cache contents to (empty to disable)")
+	var snapshotInterval = flag.Int64("snapshot-interval", 0, "seconds between periodic snapshots (0 to disable)")
+	var journalFile = flag.String("journal-file", "", "append-only log of every mutation (empty to disable)")
+	var journalFsync = flag.String("journal-fsync", "everysec", "when to sync the journal to disk (always, everysec, no)")
+	var replicationPort = flag.String("replication-port", "", "port to stream mutations to followers on (empty to disable)")
+	var replicationBind = flag.String("replication-bind", "127.0.0.1", "address to stream mutations to followers on")
+	var replicationSecret = flag.String("replication-secret", "", "secret followers send to the leader (empty to not require one)")
+	var replicateFrom = flag.String("replicate-from", "", "host:port of a leader to follow, rejecting writes until promoted")
+	var proxyConfigFile = flag.String("proxy-config", "", "json file with the pools and routes to proxy requests to (empty to serve from local storage)")
+	var proxyTimeout = flag.Int64("proxy-timeout", 1000, "milliseconds an upstream request may take in proxy mode")
+	var metricsAddr = flag.String("metrics-addr", "", "address to serve prometheus metrics on at /metrics (empty to disable)")
+	var diagnosticsAddr = flag.String("diagnostics-addr", "", "address to serve profiles and runtime statistics on at /debug (empty to disable)")
+	var heapDumpDir = flag.String("heapdump-dir", os.TempDir(), "directory heap dumps requested through /debug/heapdump are written to")
+	var shutdownTimeout = flag.Int64("shutdown-timeout", 10, "seconds busy connections get to finish their command on shutdown")
+	var enableShutdown = flag.Bool("enable-shutdown", false, "allow clients to stop the server with the shutdown command")
+	var upgradeCache = flag.Bool("upgrade-cache", false, "send the cache contents to the new process on upgrades (SIGUSR1)")
+	var journalCompactSize = flag.Int64("journal-compact-size", 64, "megabytes the journal may grow to before being compacted (0 to disable)")
 	flag.Parse()
 
+	resolveExecutable()
+	casDisabled = *disableCas
+	outputBufferSize = *outputBuffer
+	shutdownEnabled = *enableShutdown
+	var err os.Error
+	if maxItemSize, err = parseItemSize(*itemSize); err != nil {
+		logger.Fatalln(err)
+	}
 
-  /*if *memprofile != "" {*/
-    /*defer func() {*/
-      /*f, err := os.Create(*memprofile)*/
-      /*if err != nil {*/
-        /*log.Fatal(err)*/
-      /*}*/
-      /*pprof.WriteHeapProfile(f)*/
-      /*f.Close()*/
-    /*}()*/
-  /*}*/
+	if *diagnosticsAddr != "" {
+		go serveDiagnostics(*diagnosticsAddr, *heapDumpDir)
+	}
 
-  /*
 	// storage implementation selection
-	switch *storage_choice {
-	case "map":
-		logger.Print("warning, map storage does not expire entries")
-		factory = func () Storage { return newMapStorage() }
-	case "generational":
-		factory = func () Storage { return newGenerationalStorage() }
-	case "heap":
-		factory = func () Storage { return newNotifyStorage(*expiring_frequency) }
-	default:
+	backend, present := storageBackends[*storageChoice]
+	if !present {
 		logger.Fatalln("Invalid storage selection")
 	}
-*/
-	// whether using partitioned or standalone storage
-
-	if *partitions > 1 {
-    logger.Printf("Building storage with partitioning support: %d slots", *partitions)
-    updatesChannel := make(chan UpdateMessage, 5000)
-    factory = func() CacheStorage { return newMapCacheStorage() }
-    //go updateMessageLogger(updatesChannel)
-    hashingStorage := newHashingStorage(uint32(*partitions), factory)
-    storage = newEventNotifierStorage(hashingStorage, updatesChannel)
-    newGenerationalStorage(hashingStorage, updatesChannel)
+	logger.Printf("Using %s storage: %s", *storageChoice, backend.description)
+	if backend.adapted {
+		// legacy storages hold their items themselves, with no limit, slabs
+		// or meta protocol state
+		flag.Visit(func(given *flag.Flag) {
+			if given.Name == "m" {
+				logger.Fatalf("The %s storage has no memory limit, -m can't be used with it", *storageChoice)
+			}
+		})
+		*megabytes = 0
+		metaStateKept = false
 	} else {
-		storage = newMapCacheStorage()//factory()
+		slabAllocator = newSlabAllocator(*minChunk, *growthFactor, *megabytes * 1024 * 1024)
+		go slabAllocator.rebalancer(*rebalanceInterval)
 	}
+	memory := newMemoryLimit(*megabytes)
+	serverStats.limitMaxbytes = memory.limit
+	stack := backend.build(&BackendOptions{*partitions, memory, slabAllocator, *expiringInterval})
+	storage := stack.storage
 
-	// network setup
-	if addr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+*port); err != nil {
-		logger.Fatalf("Unable to resolv local port %s\n", *port)
-	} else if listener, err := net.ListenTCP("tcp", addr); err != nil {
-		logger.Fatalln("Unable to listen on requested port")
-	} else {
-    // server loop
-    logger.Printf("Starting Gocached server")
-    /*for i := 0; i < 21; i++ {*/
-    for {
-      if conn, err := listener.AcceptTCP(); err != nil {
-        logger.Println("An error ocurred accepting a new connection")
-      } else {
-        go clientHandler(conn, storage)
-      }
-    }
-  }
+	// the process being upgraded keeps serving until this one is ready, it
+	// releases the persistence files before sending its contents
+	var handoff net.Conn
+	var transferred bool
+	if upgraded {
+		var err os.Error
+		if handoff, transferred, err = receiveHandoff(storage); err != nil {
+			logger.Fatalf("Unable to take over from the previous process: %s", err)
+		}
+	}
+
+	// persistence, restore the last snapshot and the journal written after
+	// it before serving any request. Contents received from the previous
+	// process are newer, they are checkpointed instead
+	var snapshotter *Snapshotter
+	var checkpoint func()
+	if *snapshotFile != "" {
+		snapshotter = newSnapshotter(*snapshotFile, storage)
+		if !transferred {
+			if err := snapshotter.Load(); err != nil {
+				logger.Fatalf("Unable to load snapshot %s: %s", *snapshotFile, err)
+			}
+		}
+		checkpoint = snapshotter.saveOrLog
+		onHandOff(snapshotter.Pause, snapshotter.Resume)
+	}
+	if *journalFile != "" {
+		fsync, present := fsyncPolicies[*journalFsync]
+		if !present {
+			logger.Fatalln("Invalid journal fsync policy")
+		}
+		journal, err := newJournalingStorage(storage, *journalFile, fsync, *journalCompactSize * 1024 * 1024, snapshotter, !transferred)
+		if err != nil {
+			logger.Fatalf("Unable to open journal %s: %s", *journalFile, err)
+		}
+		storage = journal
+		onHandOff(journal.Pause, journal.Resume)
+		if snapshotter != nil {
+			// a snapshot on its own would be replayed along an outdated journal
+			checkpoint = journal.checkpointOrLog
+		} else {
+			onShutdown(func() { journal.Sync() })
+		}
+	}
+	if transferred && checkpoint != nil {
+		checkpoint()
+	}
+	if checkpoint != nil {
+		onSignal(os.SIGUSR2, checkpoint)
+		onShutdown(checkpoint)
+		if *snapshotInterval > 0 {
+			go periodically(*snapshotInterval, checkpoint)
+		}
+	}
+
+	// replication, followers apply the leader's stream through the whole stack
+	// so they can persist it and feed followers of their own
+	if *replicationPort != "" {
+		if *saslPasswords != "" && *replicationSecret == "" {
+			// the stream would hand out every key to whoever connects
+			logger.Fatalln("-replication-port needs -replication-secret when clients authenticate with -sasl-pwdb")
+		}
+		replicating := newReplicatingStorage(storage, *replicationSecret)
+		storage = replicating
+		if listener, err := listenRetrying("tcp", net.JoinHostPort(*replicationBind, *replicationPort)); err != nil {
+			logger.Fatalln("Unable to listen on requested replication port")
+		} else {
+			go replicating.serve(listener)
+		}
+	}
+	if *replicateFrom != "" {
+		follower = newFollower(*replicateFrom, storage, *replicationSecret)
+		go follower.run()
+	}
+
+	if stack.generational != nil {
+		onShutdown(stack.generational.Stop)
+	}
+	onSignal(os.SIGINT, connections.stopAccepting)
+	onSignal(os.SIGTERM, connections.stopAccepting)
+
+	if *proxyConfigFile != "" {
+		var err os.Error
+		if proxyRouter, err = loadRouter(*proxyConfigFile, *proxyTimeout * 1e6); err != nil {
+			logger.Fatalf("Unable to load proxy configuration %s: %s", *proxyConfigFile, err)
+		}
+		logger.Printf("Proxying requests to %d pools", len(proxyRouter.pools))
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr, stack)
+	}
+
+	// certificates are read again on SIGHUP
+	if *tlsCert != "" {
+		var err os.Error
+		if tlsSettings, err = newTLSSettings(*tlsCert, *tlsKey, *tlsClientCA, *tlsCiphers); err != nil {
+			logger.Fatalf("Unable to load the TLS configuration: %s", err)
+		}
+		onSignal(os.SIGHUP, tlsSettings.reloadOrLog)
+	} else if *tlsListen != "" {
+		logger.Fatalln("TLS listeners need -tls-cert and -tls-key")
+	}
+
+	if *saslPasswords != "" {
+		var err os.Error
+		if passwords, err = newPasswordFile(*saslPasswords); err != nil {
+			logger.Fatalf("Unable to load the password file %s: %s", *saslPasswords, err)
+		}
+		onSignal(os.SIGHUP, passwords.reloadOrLog)
+	}
+	if *aclConfigFile != "" {
+		if passwords == nil {
+			logger.Fatalln("Access rules need -sasl-pwdb")
+		}
+		var err os.Error
+		if acls, err = newACLFile(*aclConfigFile); err != nil {
+			logger.Fatalf("Unable to load the access rules %s: %s", *aclConfigFile, err)
+		}
+		onSignal(os.SIGHUP, acls.reloadOrLog)
+	}
+
+	// network setup, reusing the listeners of the process being upgraded
+	if *listen == "" && *tlsListen == "" {
+		*listen = "0.0.0.0:" + *port
+	}
+	listeners, err := inheritedListeners()
+	if err != nil {
+		logger.Fatalf("Unable to use the inherited listeners: %s", err)
+	} else if listeners == nil {
+		if *listen != "" {
+			if listeners, err = listenAll(*listen, *port, *unixMode); err != nil {
+				logger.Fatalln(err)
+			}
+		}
+		if *tlsListen != "" {
+			secure, err := listenAll(*tlsListen, *port, *unixMode)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			for _, listener := range secure {
+				listeners = append(listeners, &tlsListener{listener, tlsSettings})
+			}
+		}
+	}
+	onSignal(os.SIGUSR1, func() {
+		if err := upgrade(listeners, storage, *upgradeCache); err != nil {
+			logger.Printf("Upgrade failed, still serving: %s", err)
+		}
+	})
+	// every handler is registered by now, the map is only read from here on
+	go dispatchSignals()
+	if handoff != nil {
+		signalReady(handoff)
+	}
+
+	// serve every listener until a shutdown closes them
+	logger.Printf("Starting Gocached server")
+	if *udpPort != "" {
+		if passwords != nil {
+			logger.Fatalln("UDP requests can't be authenticated, -udp-port can't be used with -sasl-pwdb")
+		}
+		addrs := udpAddresses(*listen, *udpPort)
+		if len(addrs) == 0 {
+			logger.Fatalln("-udp-port needs a tcp address in -listen to serve on")
+		}
+		for _, addr := range addrs {
+			go serveUDP(addr, storage)
+		}
+	}
+	for _, listener := range listeners {
+		connections.listen(listener)
+		go acceptLoop(listener, storage)
+	}
+	connections.wait()
+	gracefulShutdown(*shutdownTimeout * 1e9)
 }
 
-func clientHandler(conn *net.TCPConn, store CacheStorage) {
+func clientHandler(conn net.Conn, store CacheStorage) {
 	defer conn.Close()
+	if secure, ok := conn.(*tlsConn); ok {
+		if err := secure.handshake(); err != nil {
+			logger.Printf("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	serverStats.connectionOpened()
+	defer serverStats.connectionClosed()
 	if session, err := NewSession(conn, store); err != nil {
 		logger.Println("An error ocurred creating a new session")
+	} else if connections.add(session) {
+		defer connections.remove(session)
+		session.serve()
+	}
+}
+
+/* run the loop of the protocol the client speaks */
+func (s *Session) serve() {
+	defer s.flush()
+	if proxyRouter != nil {
+		s.ProxyLoop(proxyRouter)
+	} else if s.isBinary() {
+		s.BinaryLoop()
 	} else {
-    session.CommandLoop()
+		s.CommandLoop()
 	}
 }
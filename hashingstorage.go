@@ -54,6 +54,22 @@ func (self *HashingStorage) Incr(key string, value uint64, incr bool) (ErrorCode
   return self.findBucket(key).Incr(key, value, incr)
 }
 
+func (self *HashingStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+  return self.findBucket(key).Touch(key, exptime)
+}
+
+func (self *HashingStorage) Flush() {
+  for i := uint32(0); i < self.size; i++  {
+    self.storageBuckets[i].Flush()
+  }
+}
+
+func (self *HashingStorage) Walk(f func(key string, entry *StorageEntry)) {
+  for i := uint32(0); i < self.size; i++  {
+    self.storageBuckets[i].Walk(f)
+  }
+}
+
 func (self *HashingStorage) Expire(key string) {
   self.findBucket(key).Expire(key)
 }
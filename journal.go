@@ -0,0 +1,548 @@
+package main
+
+import (
+  "os"
+  "bytes"
+  "bufio"
+  "sync"
+  "time"
+  "io/ioutil"
+  "hash/crc32"
+  "encoding/binary"
+)
+
+/* Journal file layout: "GOCJOURN" version:uint32 generation:uint64
+   followed by records of
+
+   op:byte entry crc32:uint32
+
+   where entry is encoded as in snapshots and the checksum covers op and
+   entry. Replaying the records in order over the last snapshot rebuilds the
+   storage. Version 1 journals have no generation.
+
+   A checkpoint moves the journal to <path>.prev, starts the next generation
+   and only then saves a snapshot of that generation. Recovery replays both
+   files unless the snapshot covers their generation. Records logged while
+   the snapshot is saved may be in it already, replaying them again leaves
+   the same result as they all store whole values */
+
+const (
+  journalMagic   = "GOCJOURN"
+  journalVersion = 2
+)
+
+const (
+  journalSet = iota + 1
+  journalAppend
+  journalPrepend
+  journalTouch
+  journalDelete
+  journalFlush
+)
+
+/* fsync policies */
+const (
+  FsyncAlways = iota
+  FsyncEverySecond
+  FsyncNever
+)
+
+var fsyncPolicies = map[string]int{
+  "always":   FsyncAlways,
+  "everysec": FsyncEverySecond,
+  "no":       FsyncNever,
+}
+
+/* Logs every successful mutation before returning it. Mutations run under a
+   single lock so the journal order is the order they were applied in */
+type JournalingStorage struct {
+  storage       CacheStorage
+  lock          sync.Mutex
+  path          string
+  file          *os.File
+  writer        *bufio.Writer
+  fsync         int
+  dirty         bool
+  size          int64
+  compactedSize int64
+  compactSize   int64
+  snapshotter   *Snapshotter
+  paused        bool // the file is closed while an upgraded process takes over
+  generation    uint64
+  checkpointing sync.Mutex // held for a whole checkpoint, snapshot included
+}
+
+/* replay the journal at path into storage, unless the storage already holds
+   what it describes, and open it for appending. When a snapshotter is given
+   checkpoints save a snapshot and start an empty journal, otherwise the
+   journal is rewritten from the live entries */
+func newJournalingStorage(storage CacheStorage, path string, fsync int, compactSize int64, snapshotter *Snapshotter, replay bool) (*JournalingStorage, os.Error) {
+  self := &JournalingStorage{storage: storage, path: path, fsync: fsync, compactSize: compactSize, snapshotter: snapshotter}
+  if snapshotter != nil {
+    self.generation = snapshotter.generation
+  }
+  if replay {
+    // left by a checkpoint whose snapshot wasn't saved
+    if err := self.replay(path + ".prev", true, false); err != nil {
+      return nil, err
+    }
+  }
+  if err := self.replay(path, replay, true); err != nil {
+    return nil, err
+  }
+  if err := self.open(); err != nil {
+    return nil, err
+  }
+  self.compactedSize = self.size
+  go self.maintain()
+  return self, nil
+}
+
+/* open the journal for appending, writing the header of a new one */
+func (self *JournalingStorage) open() os.Error {
+  file, err := os.OpenFile(self.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return err
+  }
+  self.file, self.writer = file, bufio.NewWriter(file)
+  if self.size == 0 {
+    header := journalHeader(self.generation)
+    self.writer.Write(header)
+    if err := self.writer.Flush(); err != nil {
+      return err
+    }
+    self.size = int64(len(header))
+  }
+  return nil
+}
+
+func journalHeader(generation uint64) []byte {
+  header := make([]byte, len(journalMagic) + 12)
+  copy(header, journalMagic)
+  binary.BigEndian.PutUint32(header[len(journalMagic):], journalVersion)
+  binary.BigEndian.PutUint64(header[len(journalMagic) + 4:], generation)
+  return header
+}
+
+/* the generation of a journal and the length of its header */
+func parseJournalHeader(data []byte) (uint64, int, os.Error) {
+  header := len(journalMagic) + 4
+  if len(data) >= header && string(data[:len(journalMagic)]) == journalMagic {
+    switch binary.BigEndian.Uint32(data[len(journalMagic):header]) {
+    case 1:
+      return 0, header, nil
+    case journalVersion:
+      if len(data) >= header + 8 {
+        return binary.BigEndian.Uint64(data[header:header + 8]), header + 8, nil
+      }
+    }
+  }
+  return 0, 0, os.NewError("Not a journal file or unsupported version")
+}
+
+func encodeJournalRecord(op byte, key string, entry *StorageEntry) []byte {
+  var buffer bytes.Buffer
+  buffer.WriteByte(op)
+  writeEntry(&buffer, key, entry)
+  sum := make([]byte, 4)
+  binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(buffer.Bytes()))
+  buffer.Write(sum)
+  return buffer.Bytes()
+}
+
+/* apply every intact record of the journal at path unless the snapshot
+   covers it. A current journal gets its torn tail cut off and is emptied
+   when covered, apply is false when the storage already holds its records */
+func (self *JournalingStorage) replay(path string, apply bool, current bool) os.Error {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    if pathError, ok := err.(*os.PathError); ok && pathError.Error == os.ENOENT {
+      return nil
+    }
+    return err
+  } else if len(data) == 0 {
+    return nil
+  }
+  generation, header, err := parseJournalHeader(data)
+  if err != nil {
+    return err
+  }
+  if generation < self.generation {
+    logger.Printf("Skipping journal %s, already in the snapshot", path)
+    if current {
+      return os.Truncate(path, 0)
+    }
+    return nil
+  }
+  self.generation = generation
+  if current {
+    self.size = int64(len(data))
+  }
+  if !apply {
+    return nil
+  }
+  valid, count := int64(header), 0
+  reader := bytes.NewBuffer(data[valid:])
+  for reader.Len() > 0 {
+    op, _ := reader.ReadByte()
+    key, entry, err := readEntry(reader)
+    if err != nil || reader.Len() < 4 {
+      break
+    }
+    end := int64(len(data) - reader.Len())
+    if crc32.ChecksumIEEE(data[valid:end]) != binary.BigEndian.Uint32(reader.Next(4)) {
+      break
+    }
+    applyJournalRecord(self.storage, op, key, entry)
+    valid, count = end + 4, count + 1
+  }
+  if valid < int64(len(data)) && current {
+    logger.Printf("Discarding %d bytes of incomplete records from journal %s", int64(len(data)) - valid, path)
+    if err := os.Truncate(path, valid); err != nil {
+      return err
+    }
+    self.size = valid
+  }
+  logger.Printf("Replayed %d records from journal %s", count, path)
+  return nil
+}
+
+/* perform the mutation a journal record describes on storage */
+func applyJournalRecord(storage CacheStorage, op byte, key string, entry *StorageEntry) {
+  switch op {
+  case journalSet:
+    if !entry.expired() {
+      storage.Set(key, entry.flags, entry.exptime, entry.bytes, entry.content)
+    } else {
+      storage.Delete(key)
+    }
+  case journalAppend: // only written by earlier versions
+    storage.Append(key, entry.bytes, entry.content)
+  case journalPrepend:
+    storage.Prepend(key, entry.bytes, entry.content)
+  case journalTouch:
+    storage.Touch(key, entry.exptime)
+  case journalDelete:
+    storage.Delete(key)
+  case journalFlush:
+    // flushes are logged once done, earlier versions logged delayed ones
+    // when requested
+    flushAll(storage, entry.exptime)
+  }
+}
+
+/* append a record to the journal. Must hold the lock */
+func (self *JournalingStorage) record(op byte, key string, entry *StorageEntry) {
+  if self.paused {
+    return
+  }
+  record := encodeJournalRecord(op, key, entry)
+  self.writer.Write(record)
+  self.size += int64(len(record))
+  if self.fsync != FsyncAlways {
+    // written out by maintain
+    self.dirty = true
+    return
+  }
+  err := self.writer.Flush()
+  if err == nil {
+    err = self.file.Sync()
+  }
+  if err != nil {
+    logger.Printf("Unable to write to journal %s: %s", self.path, err)
+  }
+}
+
+func (self *JournalingStorage) recordSet(key string, flags uint32, exptime uint32, content []byte) {
+  self.record(journalSet, key, newStorageEntry(exptime, flags, uint32(len(content)), 0, content))
+}
+
+/* write the journal out once a second, syncing it if required, and compact
+   it once it has grown past the threshold and doubled since the last
+   compaction */
+func (self *JournalingStorage) maintain() {
+  for {
+    time.Sleep(1e9)
+    self.lock.Lock()
+    if self.paused {
+      self.lock.Unlock()
+      continue
+    }
+    if self.dirty {
+      err := self.writer.Flush()
+      if err == nil && self.fsync == FsyncEverySecond {
+        err = self.file.Sync()
+      }
+      if err != nil {
+        logger.Printf("Unable to write to journal %s: %s", self.path, err)
+      }
+      self.dirty = false
+    }
+    compact := self.compactSize > 0 && self.size > self.compactSize && self.size > 2 * self.compactedSize
+    self.lock.Unlock()
+    if compact {
+      self.checkpointOrLog()
+    }
+  }
+}
+
+/* start a new journal, either followed by a fresh snapshot or rewritten
+   from the live entries */
+func (self *JournalingStorage) Checkpoint() os.Error {
+  if self.snapshotter == nil {
+    return self.rewrite()
+  }
+  self.checkpointing.Lock()
+  defer self.checkpointing.Unlock()
+  self.lock.Lock()
+  if self.paused {
+    self.lock.Unlock()
+    return os.NewError("Journal paused for an upgrade")
+  }
+  var err os.Error
+  // when the last snapshot wasn't saved its journal is still needed, the
+  // current one is then the one to cover
+  if _, statErr := os.Stat(self.path + ".prev"); statErr != nil {
+    err = self.rotate()
+  }
+  generation := self.generation
+  self.lock.Unlock()
+  if err != nil {
+    return err
+  }
+  // mutations go on, the walk is as consistent as a replay needs it to be
+  if err = self.snapshotter.saveGeneration(generation); err != nil {
+    return err
+  }
+  os.Remove(self.path + ".prev")
+  logger.Printf("Started generation %d of journal %s", generation, self.path)
+  return nil
+}
+
+/* move the journal to <path>.prev and start the next generation. Must hold
+   the lock */
+func (self *JournalingStorage) rotate() os.Error {
+  tmpPath := self.path + ".tmp"
+  file, err := os.Create(tmpPath)
+  if err != nil {
+    return err
+  }
+  header := journalHeader(self.generation + 1)
+  if _, err = file.Write(header); err == nil {
+    err = file.Sync()
+  }
+  if err == nil {
+    err = self.writer.Flush()
+  }
+  if err == nil {
+    err = self.file.Sync()
+  }
+  if err == nil {
+    err = os.Rename(self.path, self.path + ".prev")
+  }
+  if err == nil {
+    err = os.Rename(tmpPath, self.path)
+  }
+  if err != nil {
+    file.Close()
+    return err
+  }
+  self.file.Close()
+  self.file, self.writer = file, bufio.NewWriter(file)
+  self.generation++
+  self.size, self.compactedSize, self.dirty = int64(len(header)), int64(len(header)), false
+  return nil
+}
+
+/* replace the journal with one holding a set of every live entry */
+func (self *JournalingStorage) rewrite() os.Error {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if self.paused {
+    return os.NewError("Journal paused for an upgrade")
+  }
+  tmpPath := self.path + ".tmp"
+  file, err := os.Create(tmpPath)
+  if err != nil {
+    return err
+  }
+  writer := bufio.NewWriter(file)
+  writer.Write(journalHeader(self.generation))
+  // the snapshot on disk, if any, is stale. Start from an empty storage
+  writer.Write(encodeJournalRecord(journalFlush, "", &StorageEntry{}))
+  self.storage.Walk(func(key string, entry *StorageEntry) {
+    writer.Write(encodeJournalRecord(journalSet, key, entry))
+  })
+  err = writer.Flush()
+  if err == nil {
+    err = file.Sync()
+  }
+  if err == nil {
+    err = os.Rename(tmpPath, self.path)
+  }
+  if err != nil {
+    file.Close()
+    return err
+  }
+  size, _ := file.Seek(0, 1)
+  self.file.Close()
+  self.file, self.writer = file, bufio.NewWriter(file)
+  self.size, self.compactedSize, self.dirty = size, size, false
+  logger.Printf("Compacted journal %s to %d bytes", self.path, size)
+  return nil
+}
+
+func (self *JournalingStorage) checkpointOrLog() {
+  if err := self.Checkpoint(); err != nil {
+    logger.Printf("Unable to compact journal %s: %s", self.path, err)
+  }
+}
+
+/* flush and sync the journal, used on shutdown */
+func (self *JournalingStorage) Sync() os.Error {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if self.paused {
+    return nil
+  }
+  if err := self.writer.Flush(); err != nil {
+    return err
+  }
+  return self.file.Sync()
+}
+
+/* sync and close the journal so an upgraded process can take it over.
+   Mutations go on without being logged until Resume */
+func (self *JournalingStorage) Pause() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if err := self.writer.Flush(); err == nil {
+    self.file.Sync()
+  }
+  self.file.Close()
+  self.paused = true
+}
+
+/* open the journal again after a failed upgrade. What was missed while
+   paused only reaches it through a checkpoint */
+func (self *JournalingStorage) Resume() {
+  self.lock.Lock()
+  if err := self.open(); err != nil {
+    logger.Printf("Unable to reopen journal %s: %s", self.path, err)
+    self.lock.Unlock()
+    return
+  }
+  self.paused = false
+  self.lock.Unlock()
+  self.checkpointOrLog()
+}
+
+func (self *JournalingStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (*StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous, updated := self.storage.Set(key, flags, exptime, bytes, content)
+  self.recordSet(key, flags, exptime, content)
+  return previous, updated
+}
+
+func (self *JournalingStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, updated := self.storage.Add(key, flags, exptime, bytes, content)
+  if err == Ok {
+    self.recordSet(key, flags, exptime, content)
+  }
+  return err, updated
+}
+
+func (self *JournalingStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Replace(key, flags, exptime, bytes, content)
+  if err == Ok {
+    self.recordSet(key, flags, exptime, content)
+  }
+  return err, previous, updated
+}
+
+/* appends and prepends are logged as sets of the result, replaying them
+   over a snapshot that already has them must not add the data twice */
+func (self *JournalingStorage) Append(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Append(key, bytes, content)
+  if err == Ok {
+    self.recordSet(key, updated.flags, updated.exptime, updated.content)
+  }
+  return err, previous, updated
+}
+
+func (self *JournalingStorage) Prepend(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Prepend(key, bytes, content)
+  if err == Ok {
+    self.recordSet(key, updated.flags, updated.exptime, updated.content)
+  }
+  return err, previous, updated
+}
+
+func (self *JournalingStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Cas(key, flags, exptime, bytes, cas_unique, content)
+  if err == Ok {
+    self.recordSet(key, flags, exptime, content)
+  }
+  return err, previous, updated
+}
+
+func (self *JournalingStorage) Get(key string) (ErrorCode, *StorageEntry) {
+  return self.storage.Get(key)
+}
+
+func (self *JournalingStorage) Delete(key string) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, deleted := self.storage.Delete(key)
+  if err == Ok {
+    self.record(journalDelete, key, &StorageEntry{})
+  }
+  return err, deleted
+}
+
+/* the result of an increment lives outside the slabs, log it as a set */
+func (self *JournalingStorage) Incr(key string, value uint64, incr bool) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Incr(key, value, incr)
+  if err == Ok {
+    self.recordSet(key, updated.flags, updated.exptime, updated.content)
+  }
+  return err, previous, updated
+}
+
+func (self *JournalingStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Touch(key, exptime)
+  if err == Ok {
+    self.record(journalTouch, key, &StorageEntry{exptime: exptime})
+  }
+  return err, previous, updated
+}
+
+func (self *JournalingStorage) Flush() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.storage.Flush()
+  self.record(journalFlush, "", &StorageEntry{})
+}
+
+func (self *JournalingStorage) Walk(f func(key string, entry *StorageEntry)) {
+  self.storage.Walk(f)
+}
+
+func (self *JournalingStorage) Expire(key string) {
+  self.storage.Expire(key)
+}
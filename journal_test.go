@@ -0,0 +1,93 @@
+package main
+
+import (
+  "os"
+  "testing"
+  "time"
+)
+
+func TestJournalReplaysMutations(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test.journal"
+  os.Remove(path)
+  defer os.Remove(path)
+
+  journal, err := newJournalingStorage(newMapCacheStorage(newMemoryLimit(0), nil), path, FsyncNever, 0, nil, true)
+  assertEquals(t, err == nil, true, "journal not created")
+  journal.Set("foo", 0, 0, 3, []byte("bar"))
+  journal.Append("foo", 3, []byte("baz"))
+  journal.Set("counter", 0, 0, 1, []byte("1"))
+  journal.Incr("counter", 41, true)
+  journal.Set("gone", 0, 0, 3, []byte("old"))
+  journal.Delete("gone")
+  journal.Sync()
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  _, err = newJournalingStorage(storage, path, FsyncNever, 0, nil, true)
+  assertEquals(t, err == nil, true, "journal not replayed")
+
+  _, entry := storage.Get("foo")
+  assertEquals(t, string(entry.content), "barbaz", "append not replayed")
+  _, entry = storage.Get("counter")
+  assertEquals(t, string(entry.content), "42", "incr not replayed")
+  code, _ := storage.Get("gone")
+  assertEquals(t, code, ErrorCode(KeyNotFound), "delete not replayed")
+}
+
+func TestJournalSkipsRecordsInTheSnapshot(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test.journal"
+  snapshotPath := os.TempDir() + "/gocached_test.snapshot"
+  for _, file := range []string{path, path + ".prev", snapshotPath} {
+    os.Remove(file)
+    defer os.Remove(file)
+  }
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  journal, err := newJournalingStorage(storage, path, FsyncNever, 0, newSnapshotter(snapshotPath, storage), true)
+  assertEquals(t, err == nil, true, "journal not created")
+  journal.Set("foo", 0, 0, 3, []byte("bar"))
+  journal.Append("foo", 3, []byte("baz"))
+
+  // a crash right after the snapshot, before the previous journal is removed
+  journal.lock.Lock()
+  journal.rotate()
+  journal.lock.Unlock()
+  journal.Append("foo", 3, []byte("qux"))
+  journal.snapshotter.saveGeneration(journal.generation)
+  journal.Sync()
+
+  storage = newMapCacheStorage(newMemoryLimit(0), nil)
+  snapshotter := newSnapshotter(snapshotPath, storage)
+  assertEquals(t, snapshotter.Load() == nil, true, "snapshot not loaded")
+  _, err = newJournalingStorage(storage, path, FsyncNever, 0, snapshotter, true)
+  assertEquals(t, err == nil, true, "journal not replayed")
+
+  _, entry := storage.Get("foo")
+  assertEquals(t, string(entry.content), "barbazqux", "records replayed twice")
+}
+
+func TestJournalLogsDelayedFlushesWhenDone(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test.journal"
+  os.Remove(path)
+  defer os.Remove(path)
+
+  journal, err := newJournalingStorage(newMapCacheStorage(newMemoryLimit(0), nil), path, FsyncNever, 0, nil, true)
+  assertEquals(t, err == nil, true, "journal not created")
+  journal.Set("before", 0, 0, 3, []byte("old"))
+  flushAll(journal, uint32(time.Seconds()) + 1)
+  journal.Set("meanwhile", 0, 0, 3, []byte("old"))
+  time.Sleep(2.5e9)
+  journal.Set("after", 0, 0, 3, []byte("new"))
+  journal.Sync()
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  _, err = newJournalingStorage(storage, path, FsyncNever, 0, nil, true)
+  assertEquals(t, err == nil, true, "journal not replayed")
+
+  code, _ := storage.Get("meanwhile")
+  assertEquals(t, code, ErrorCode(KeyNotFound), "item stored before the flush kept")
+  _, entry := storage.Get("after")
+  assertEquals(t, string(entry.content), "new", "item stored after the flush dropped")
+}
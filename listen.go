@@ -0,0 +1,93 @@
+package main
+
+import (
+  "os"
+  "net"
+  "strings"
+  "strconv"
+)
+
+/* Addresses given to -listen, separated by commas:
+
+   10.0.0.1:11211          an IPv4 address
+   [::1]:11211             an IPv6 address
+   [::]:11211              every IPv4 and IPv6 address
+   10.0.0.1                an address on the port given by -port
+   unix:/run/gocached.sock a unix domain socket, created with -unix-mode */
+
+/* the network and address to listen on for a -listen address */
+func listenAddress(addr string, defaultPort string) (network string, address string) {
+  if strings.HasPrefix(addr, "unix:") {
+    return "unix", addr[len("unix:"):]
+  } else if strings.HasPrefix(addr, "/") {
+    return "unix", addr
+  }
+  if _, _, err := net.SplitHostPort(addr); err != nil {
+    // no port, brackets around IPv6 addresses are optional then
+    addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+  }
+  return "tcp", addr
+}
+
+/* listen on every address of the comma separated list */
+func listenAll(addrs string, defaultPort string, unixMode string) ([]net.Listener, os.Error) {
+  mode, err := strconv.Btoui64(unixMode, 8)
+  if err != nil {
+    return nil, os.NewError("Invalid unix socket mode " + unixMode)
+  }
+  var listeners []net.Listener
+  for _, addr := range strings.Split(addrs, ",") {
+    if addr = strings.TrimSpace(addr); addr == "" {
+      continue
+    }
+    network, address := listenAddress(addr, defaultPort)
+    var listener net.Listener
+    if network == "unix" {
+      listener, err = listenUnix(address, uint32(mode))
+    } else {
+      listener, err = net.Listen(network, address)
+    }
+    if err != nil {
+      for _, listener := range listeners {
+        listener.Close()
+      }
+      return nil, os.NewError("Unable to listen on " + addr + ": " + err.String())
+    }
+    logger.Printf("Listening on %s %s", network, address)
+    listeners = append(listeners, listener)
+  }
+  if len(listeners) == 0 {
+    return nil, os.NewError("No address to listen on")
+  }
+  return listeners, nil
+}
+
+/* listen on a unix socket at path, replacing the socket file a previous
+   process left behind */
+func listenUnix(path string, mode uint32) (net.Listener, os.Error) {
+  if info, err := os.Lstat(path); err == nil && info.IsSocket() {
+    os.Remove(path)
+  }
+  listener, err := net.Listen("unix", path)
+  if err != nil {
+    return nil, err
+  }
+  if err = os.Chmod(path, mode); err != nil {
+    listener.Close()
+    return nil, err
+  }
+  return listener, nil
+}
+
+/* accept connections on listener until the server stops accepting */
+func acceptLoop(listener net.Listener, store CacheStorage) {
+  for !connections.isDraining() {
+    if conn, err := listener.Accept(); err != nil {
+      if !connections.isDraining() {
+        logger.Println("An error ocurred accepting a new connection")
+      }
+    } else {
+      go clientHandler(conn, store)
+    }
+  }
+}
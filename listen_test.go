@@ -0,0 +1,22 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestListenAddresses(t *testing.T) {
+
+  for _, test := range []struct{ addr, network, address string }{
+    {"10.0.0.1:11211", "tcp", "10.0.0.1:11211"},
+    {"10.0.0.1", "tcp", "10.0.0.1:11212"},
+    {"[::1]:11211", "tcp", "[::1]:11211"},
+    {"[::]", "tcp", "[::]:11212"},
+    {"::1", "tcp", "[::1]:11212"},
+    {"unix:/tmp/gocached.sock", "unix", "/tmp/gocached.sock"},
+    {"/tmp/gocached.sock", "unix", "/tmp/gocached.sock"},
+  } {
+    network, address := listenAddress(test.addr, "11212")
+    assertEquals(t, network, test.network, "wrong network for " + test.addr)
+    assertEquals(t, address, test.address, "wrong address for " + test.addr)
+  }
+}
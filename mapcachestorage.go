@@ -4,21 +4,29 @@ import (
   "sync"
   "time"
   "strconv"
+  "container/list"
 )
 
 type MapCacheStorage struct {
 	storageMap map[string]*StorageEntry
 	rwLock     sync.RWMutex
+	// most recently used keys at the front
+	lru        *list.List
+	memory     *MemoryLimit
+	slabs      *SlabAllocator
+	// bytes of item data held by this partition
+	usedBytes  int64
 }
 
-func newMapCacheStorage() *MapCacheStorage {
-  storage := &MapCacheStorage{}
+func newMapCacheStorage(memory *MemoryLimit, slabs *SlabAllocator) *MapCacheStorage {
+  storage := &MapCacheStorage{memory: memory, slabs: slabs}
   storage.Init()
   return storage
 }
 
 func (self *MapCacheStorage) Init() {
 	self.storageMap = make(map[string]*StorageEntry)
+	self.lru = list.New()
 }
 
 func (self *StorageEntry) expired() bool {
@@ -29,18 +37,120 @@ func (self *StorageEntry) expired() bool {
   return self.exptime <= now
 }
 
+/* items looked at from the LRU tail for one of a class short of chunks */
+const slabEvictionSearch = 50
+
+/* build an entry with a copy of the given content parts, stored in memory
+   owned by the storage since callers reuse their buffers. Must hold the
+   write lock */
+func (self *MapCacheStorage) newEntry(exptime uint32, flags uint32, bytes uint32, cas_unique uint64, parts ...[]byte) *StorageEntry {
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	chunk := self.slabs.Alloc(size)
+	for tries := 0; chunk == nil && tries < 5 && self.evictClass(self.slabs.classFor(size)); tries++ {
+		chunk = self.slabs.Alloc(size)
+	}
+	if chunk == nil {
+		// nothing of that size to evict here or still being read, the heap
+		// holds it until the rebalancer gives the class a page
+		chunk = &SlabChunk{memory: make([]byte, size), refs: 1}
+	}
+	offset := 0
+	for _, part := range parts {
+		offset += copy(chunk.memory[offset:], part)
+	}
+	entry := newStorageEntry(exptime, flags, bytes, cas_unique, chunk.memory[:size])
+	entry.chunk = chunk
+	return entry
+}
+
+/* store an entry under key, replacing any previous one, and evict the least
+   recently used entries while over the memory limit. Must hold the write lock */
+func (self *MapCacheStorage) link(key string, entry *StorageEntry) {
+	if previous, present := self.storageMap[key]; present {
+		self.unlink(key, previous)
+	}
+	self.storageMap[key] = entry
+	entry.lruElement = self.lru.PushFront(key)
+	self.slabs.own(entry.chunk, self, key)
+	self.memory.add(entrySize(key, entry))
+	self.usedBytes += int64(entry.bytes)
+	serverStats.itemLinked(entry)
+	self.evict(entry)
+}
+
+/* remove the entry stored under key. Must hold the write lock */
+func (self *MapCacheStorage) unlink(key string, entry *StorageEntry) {
+	self.storageMap[key] = nil, false
+	self.lru.Remove(entry.lruElement)
+	self.memory.add(-entrySize(key, entry))
+	self.usedBytes -= int64(entry.bytes)
+	serverStats.itemUnlinked(entry)
+	entry.release()
+}
+
+/* evict from the tail of this partition's LRU until the shared limit is met.
+   Partitions only evict their own entries, keys are evenly spread so this
+   approximates a global LRU without a global lock */
+func (self *MapCacheStorage) evict(keep *StorageEntry) {
+	for self.memory.exceeded() {
+		oldest := self.lru.Back()
+		if oldest == nil || oldest == keep.lruElement {
+			return
+		}
+		key := oldest.Value.(string)
+		self.evictEntry(key, self.storageMap[key])
+	}
+}
+
+/* evict the least recently used entry among the last ones whose chunk is
+   of class, false if there is none. Must hold the write lock */
+func (self *MapCacheStorage) evictClass(class *SlabClass) bool {
+	element := self.lru.Back()
+	for i := 0; element != nil && i < slabEvictionSearch; i++ {
+		key := element.Value.(string)
+		victim := self.storageMap[key]
+		if victim.chunk != nil && victim.chunk.page != nil && victim.chunk.page.class == class {
+			self.evictEntry(key, victim)
+			return true
+		}
+		element = element.Prev()
+	}
+	return false
+}
+
+/* the rebalancer takes the page of chunk away */
+func (self *MapCacheStorage) evictChunk(key string, chunk *SlabChunk) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	if entry, present := self.storageMap[key]; present && entry.chunk == chunk {
+		self.evictEntry(key, entry)
+	}
+}
+
+/* Must hold the write lock */
+func (self *MapCacheStorage) evictEntry(key string, victim *StorageEntry) {
+	if !victim.expired() {
+		serverStats.evict()
+		self.slabs.noteEvicted(victim.chunk)
+	}
+	self.unlink(key, victim)
+}
+
 func (self *MapCacheStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (previous *StorageEntry, result *StorageEntry) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
 	var newEntry *StorageEntry
 	if present && !entry.expired() {
-		newEntry = &StorageEntry{exptime, flags, bytes, entry.cas_unique + 1, content}
-	  self.storageMap[key] = newEntry
+		newEntry = self.newEntry(exptime, flags, bytes, nextCas(), content)
+	  self.link(key, newEntry)
     return entry, newEntry
 	}
-	newEntry = &StorageEntry{exptime, flags, bytes, 0, content}
-	self.storageMap[key] = newEntry
+	newEntry = self.newEntry(exptime, flags, bytes, nextCas(), content)
+	self.link(key, newEntry)
 	return nil, newEntry
 }
 
@@ -51,8 +161,8 @@ func (self *MapCacheStorage) Add(key string, flags uint32, exptime uint32, bytes
 	if present && !entry.expired() {
 		return KeyAlreadyInUse, nil
 	}
-  entry = &StorageEntry{exptime, flags, bytes, 0, content}
-	self.storageMap[key] = entry
+  entry = self.newEntry(exptime, flags, bytes, nextCas(), content)
+	self.link(key, entry)
 	return Ok, entry
 }
 
@@ -61,8 +171,8 @@ func (self *MapCacheStorage) Replace(key string, flags uint32, exptime uint32, b
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
 	if present && !entry.expired() {
-		newEntry := &StorageEntry{exptime, flags, bytes, entry.cas_unique + 1, content}
-		self.storageMap[key] = newEntry
+		newEntry := self.newEntry(exptime, flags, bytes, nextCas(), content)
+		self.link(key, newEntry)
 		return Ok, entry, newEntry
 	}
 	return KeyNotFound, nil, nil
@@ -73,11 +183,8 @@ func (self *MapCacheStorage) Append(key string, bytes uint32, content []byte) (E
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
 	if present && !entry.expired() {
-		newContent := make([]byte, len(entry.content)+len(content))
-		copy(newContent, entry.content)
-		copy(newContent[len(entry.content):], content)
-		newEntry := &StorageEntry{entry.exptime, entry.flags, bytes + entry.bytes, entry.cas_unique + 1, newContent}
-		self.storageMap[key] = newEntry
+		newEntry := self.newEntry(entry.exptime, entry.flags, bytes + entry.bytes, nextCas(), entry.content, content)
+		self.link(key, newEntry)
 		return Ok, entry, newEntry
 	}
 	return KeyNotFound, nil, nil
@@ -88,12 +195,9 @@ func (self *MapCacheStorage) Prepend(key string, bytes uint32, content []byte) (
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
 	if present && !entry.expired() {
-		newContent := make([]byte, len(entry.content)+len(content))
-		copy(newContent, content)
-		copy(newContent[len(content):], entry.content)
-		newEntry := &StorageEntry{entry.exptime, entry.flags, bytes + entry.bytes,
-			entry.cas_unique + 1, newContent}
-		self.storageMap[key] = newEntry
+		newEntry := self.newEntry(entry.exptime, entry.flags, bytes + entry.bytes,
+			nextCas(), content, entry.content)
+		self.link(key, newEntry)
 		return Ok, entry, newEntry
 	}
 	return KeyNotFound, nil, nil
@@ -105,8 +209,8 @@ func (self *MapCacheStorage) Cas(key string, flags uint32, exptime uint32, bytes
 	entry, present := self.storageMap[key]
 	if present && !entry.expired() {
 		if entry.cas_unique == cas_unique {
-			newEntry := &StorageEntry{exptime, flags, bytes, cas_unique, content}
-			self.storageMap[key] = newEntry
+			newEntry := self.newEntry(exptime, flags, bytes, nextCas(), content)
+			self.link(key, newEntry)
 			return Ok, entry, newEntry
 		} else {
 			return IllegalParameter, entry, nil
@@ -116,10 +220,14 @@ func (self *MapCacheStorage) Cas(key string, flags uint32, exptime uint32, bytes
 }
 
 func (self *MapCacheStorage) Get(key string) (ErrorCode, *StorageEntry) {
-	self.rwLock.RLock()
-	defer self.rwLock.RUnlock()
+	// fetching updates the entry metadata, so a read lock is not enough
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
 	if present && !entry.expired() {
+		entry.fetch()
+		entry.acquire()
+		self.lru.MoveToFront(entry.lruElement)
 		return Ok, entry
 	}
   return KeyNotFound, nil
@@ -130,7 +238,7 @@ func (self *MapCacheStorage) Delete(key string) (ErrorCode, *StorageEntry) {
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
 	if present && !entry.expired() {
-		self.storageMap[key] = nil, false
+		self.unlink(key, entry)
 		return Ok, entry
 	}
 	return KeyNotFound, nil
@@ -141,17 +249,20 @@ func (self *MapCacheStorage) Incr(key string, value uint64, incr bool) (ErrorCod
 	defer self.rwLock.Unlock()
 	entry, present := self.storageMap[key]
   if present && !entry.expired() {
-	  if addValue, err := strconv.Atoui(string(entry.content)); err == nil {
+	  if addValue, err := strconv.Atoui64(string(entry.content)); err == nil {
 		  var incrValue uint64
 		  if incr {
-			  incrValue = uint64(addValue) + value
-		  } else {
-			  incrValue = uint64(addValue) - value
+			  incrValue = addValue + value // wraps around at 64 bits
+		  } else if addValue > value {
+			  incrValue = addValue - value // decr stops at 0
 		  }
-		  incrStrValue := strconv.Uitoa64(incrValue)
-      old_value := entry.content
-		  entry.content = []byte(incrStrValue)
-		  return Ok, &StorageEntry{entry.exptime, entry.flags, entry.bytes, entry.cas_unique, old_value}, entry
+		  // counters are tiny and handed back to the client after the lock is
+		  // released, so they are left to the heap instead of a slab chunk
+		  newContent := []byte(strconv.Uitoa64(incrValue))
+		  newEntry := newStorageEntry(entry.exptime, entry.flags, uint32(len(newContent)), nextCas(), newContent)
+		  newEntry.fetched = entry.fetched
+		  self.link(key, newEntry)
+		  return Ok, entry, newEntry
 	  } else {
 	    return IllegalParameter, nil, nil
     }
@@ -159,14 +270,57 @@ func (self *MapCacheStorage) Incr(key string, value uint64, incr bool) (ErrorCod
 	return KeyNotFound, nil, nil
 }
 
-/* keep a null object for map deletion */
-var nullStorageEntry = &StorageEntry{}
+func (self *MapCacheStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	entry, present := self.storageMap[key]
+	if present && !entry.expired() {
+		newEntry := newStorageEntry(exptime, entry.flags, entry.bytes, nextCas(), entry.content)
+		newEntry.chunk = entry.chunk
+		newEntry.acquire()
+		newEntry.fetched, newEntry.lastAccess = entry.fetched, entry.lastAccess
+		newEntry.stale, newEntry.won = entry.stale, entry.won
+		self.link(key, newEntry)
+		return Ok, entry, newEntry
+	}
+	return KeyNotFound, nil, nil
+}
+
+func (self *MapCacheStorage) Flush() {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	self.flush()
+}
+
+/* drop every entry. Must hold the write lock */
+func (self *MapCacheStorage) flush() {
+	for key, entry := range self.storageMap {
+		self.unlink(key, entry)
+	}
+}
+
+func (self *MapCacheStorage) usage() (int, int64) {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	return len(self.storageMap), self.usedBytes
+}
+
+func (self *MapCacheStorage) Walk(f func(key string, entry *StorageEntry)) {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	for key, entry := range self.storageMap {
+		if !entry.expired() {
+			f(key, entry)
+		}
+	}
+}
 
 func (self *MapCacheStorage) Expire(key string) {
 	self.rwLock.Lock()
 	defer self.rwLock.Unlock()
-  _, present := self.storageMap[key]
-	if present {
-		self.storageMap[key] = nullStorageEntry, false
+  entry, present := self.storageMap[key]
+	// the key may have been stored again since it was scheduled to expire
+	if present && entry.expired() {
+		self.unlink(key, entry)
 	}
 }
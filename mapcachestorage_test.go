@@ -0,0 +1,54 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+
+  memory := &MemoryLimit{limit: 3 * (entryOverhead + 6)}
+  storage := newMapCacheStorage(memory, nil)
+
+  storage.Set("aaa", 0, 0, 3, []byte("aaa"))
+  storage.Set("bbb", 0, 0, 3, []byte("bbb"))
+  storage.Set("ccc", 0, 0, 3, []byte("ccc"))
+  storage.Get("aaa")
+  storage.Set("ddd", 0, 0, 3, []byte("ddd"))
+
+  err, _ := storage.Get("bbb")
+  assertEquals(t, err, ErrorCode(KeyNotFound), "least recently used entry not evicted")
+  err, _ = storage.Get("aaa")
+  assertEquals(t, err, ErrorCode(Ok), "recently used entry evicted")
+  err, _ = storage.Get("ddd")
+  assertEquals(t, err, ErrorCode(Ok), "new entry evicted")
+}
+
+func TestMemoryLimitIsSharedByPartitions(t *testing.T) {
+
+  memory := &MemoryLimit{limit: 2 * (entryOverhead + 6)}
+  first := newMapCacheStorage(memory, nil)
+  second := newMapCacheStorage(memory, nil)
+
+  first.Set("aaa", 0, 0, 3, []byte("aaa"))
+  second.Set("bbb", 0, 0, 3, []byte("bbb"))
+  second.Set("ccc", 0, 0, 3, []byte("ccc"))
+
+  err, _ := second.Get("bbb")
+  assertEquals(t, err, ErrorCode(KeyNotFound), "limit not shared between partitions")
+}
+
+func TestCasIsNeverReused(t *testing.T) {
+
+  storage := newMapCacheStorage(&MemoryLimit{}, nil)
+
+  _, first := storage.Set("foo", 0, 0, 1, []byte("1"))
+  storage.Delete("foo")
+  _, second := storage.Add("foo", 0, 0, 1, []byte("1"))
+  assertNotEquals(t, first.cas_unique, second.cas_unique, "cas reused after delete")
+
+  _, _, incremented := storage.Incr("foo", 1, true)
+  assertNotEquals(t, second.cas_unique, incremented.cas_unique, "cas not updated by incr")
+
+  _, _, touched := storage.Touch("foo", 0)
+  assertNotEquals(t, incremented.cas_unique, touched.cas_unique, "cas not updated by touch")
+}
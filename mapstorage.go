@@ -140,20 +140,44 @@ func (self *MapStorage) Incr(key string, value uint64, incr bool) (resultValue u
 	if !present {
 		return 0, os.NewError("Key not found")
 	}
-	if addValue, err := strconv.Atoui(string(entry.content)); err == nil {
+	if addValue, err := strconv.Atoui64(string(entry.content)); err == nil {
 		var incrValue uint64
 		if incr {
-			incrValue = uint64(addValue) + value
-		} else {
-			incrValue = uint64(addValue) - value
+			incrValue = addValue + value
+		} else if addValue > value {
+			incrValue = addValue - value
 		}
 		incrStrValue := strconv.Uitoa64(incrValue)
 		entry.content = []byte(incrStrValue)
+		entry.bytes = uint32(len(entry.content))
+		self.storageMap[key] = entry
 		return incrValue, nil
 	}
 	return 0, os.NewError("Error: bad formed decimal value")
 }
 
+func (self *MapStorage) Flush() {
+	self.rwLock.Lock()
+	defer self.rwLock.Unlock()
+	self.storageMap = make(map[string]mapStorageEntry)
+}
+
+func (self *MapStorage) Walk(f func(key string, entry *StorageEntry)) {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	for key, entry := range self.storageMap {
+		if !entry.expired() {
+			f(key, newStorageEntry(entry.exptime, entry.flags, entry.bytes, entry.cas_unique, entry.content))
+		}
+	}
+}
+
+func (self *MapStorage) Exptime(key string) uint32 {
+	self.rwLock.RLock()
+	defer self.rwLock.RUnlock()
+	return self.storageMap[key].exptime
+}
+
 func (self *MapStorage) Get(key string) (flags uint32, bytes uint32, cas_unique uint64, content []byte, err os.Error) {
 	self.rwLock.RLock()
 	defer self.rwLock.RUnlock()
@@ -2,6 +2,7 @@ package main
 
 import (
   "testing"
+  "time"
 )
 
 
@@ -120,3 +121,30 @@ func assertNotEquals(t *testing.T, a interface{}, b interface{}, cause string) {
     t.Error(cause);
   }
 }
+
+func TestAdapterReportsExptime(t *testing.T) {
+
+  storage := newStorageAdapter(newMapStorage())
+
+  exptime := uint32(time.Seconds()) + 60
+  storage.Set("foo", 0, exptime, 5, []byte("babab"))
+  _, entry := storage.Get("foo")
+
+  assertEquals(t, entry.exptime, exptime, "invalid exptime")
+}
+
+func TestAdapterCasChangesOnEveryMutation(t *testing.T) {
+
+  storage := newStorageAdapter(newMapStorage())
+
+  _, stored := storage.Set("foo", 0, 0, 5, []byte("babab"))
+  first := stored.cas_unique
+  err, _, stored := storage.Cas("foo", 0, 0, 5, first, []byte("bebeb"))
+  assertEquals(t, err, Ok, "cas with the current value should succeed")
+  assertNotEquals(t, stored.cas_unique, first, "cas should assign a new value")
+
+  err, _, _ = storage.Cas("foo", 0, 0, 5, first, []byte("bibib"))
+  assertEquals(t, err, IllegalParameter, "cas with a stale value should fail")
+  _, entry := storage.Get("foo")
+  assertEquals(t, string(entry.content), "bebeb", "stale cas should not store")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+  "os"
+  "strings"
+  "strconv"
+  "sync/atomic"
+)
+
+/* approximate memory taken by an entry besides its key and content: the
+   entry itself, its map slot and its LRU list element */
+const entryOverhead = 96
+
+/* largest item data accepted, set by -I */
+var maxItemSize = 1024 * 1024
+
+/* a size in bytes with an optional k or m suffix */
+func parseItemSize(size string) (int, os.Error) {
+  multiplier := uint64(1)
+  switch {
+  case strings.HasSuffix(size, "k"):
+    multiplier, size = 1024, size[:len(size)-1]
+  case strings.HasSuffix(size, "m"):
+    multiplier, size = 1024 * 1024, size[:len(size)-1]
+  }
+  value, err := strconv.Atoui64(size)
+  if err != nil || value == 0 || value * multiplier > 1 << 30 {
+    return 0, os.NewError("Invalid item size " + size)
+  }
+  return int(value * multiplier), nil
+}
+
+/* memory accounting shared by every storage partition, so the limit applies
+   to the server as a whole. A limit of 0 means unlimited */
+type MemoryLimit struct {
+  limit int64
+  used  int64
+}
+
+func newMemoryLimit(megabytes int64) *MemoryLimit {
+  return &MemoryLimit{limit: megabytes * 1024 * 1024}
+}
+
+/* memory charged for an entry, its whole chunk even when the content only
+   fills part of it */
+func entrySize(key string, entry *StorageEntry) int64 {
+  size := int64(len(entry.content))
+  if entry.chunk != nil {
+    size = int64(len(entry.chunk.memory))
+  }
+  return int64(len(key)) + size + entryOverhead
+}
+
+func (self *MemoryLimit) add(size int64) {
+  atomic.AddInt64(&self.used, size)
+}
+
+func (self *MemoryLimit) exceeded() bool {
+  return self.limit > 0 && atomic.LoadInt64(&self.used) > self.limit
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+  "io"
+  "fmt"
+  "sort"
+  "time"
+  "http"
+  "strconv"
+  "sync/atomic"
+)
+
+/* upper bounds of the command latency histogram buckets, in nanoseconds */
+var latencyBuckets = []int64{1e4, 5e4, 1e5, 5e5, 1e6, 5e6, 1e7, 5e7, 1e8, 5e8, 1e9}
+
+/* count and latency histogram of a command, updated atomically */
+type CommandMetrics struct {
+  count   uint64
+  nanos   uint64
+  buckets []uint64 // not cumulative, the last one counts what is beyond every bound
+}
+
+/* only known commands are tracked so clients can't grow the label set */
+var commandMetrics = make(map[string]*CommandMetrics)
+
+func init() {
+  for _, name := range []string{"get", "gets", "gat", "gats", "set", "add", "replace", "append",
+                                "prepend", "cas", "delete", "touch", "incr", "decr", "mg", "ms",
+                                "md", "ma", "mn", "me", "stats", "flush_all", "noop", "version"} {
+    commandMetrics[name] = &CommandMetrics{buckets: make([]uint64, len(latencyBuckets) + 1)}
+  }
+}
+
+/* text command names of the binary opcodes */
+var binaryCommandNames = map[uint8]string{
+  opGet: "get", opGetq: "get", opGetk: "get", opGetkq: "get", opSet: "set", opAdd: "add",
+  opReplace: "replace", opDelete: "delete", opIncr: "incr", opDecr: "decr", opFlush: "flush_all",
+  opNoop: "noop", opVersion: "version", opAppend: "append", opPrepend: "prepend", opStat: "stats",
+  opTouch: "touch", opGat: "gat", opGatq: "gat",
+}
+
+/* account for a command that started at start nanoseconds */
+func observeCommand(name string, start int64) {
+  metrics := commandMetrics[name]
+  if metrics == nil {
+    return
+  }
+  elapsed := time.Nanoseconds() - start
+  atomic.AddUint64(&metrics.count, 1)
+  atomic.AddUint64(&metrics.nanos, uint64(elapsed))
+  bucket := sort.Search(len(latencyBuckets), func(i int) bool { return elapsed <= latencyBuckets[i] })
+  atomic.AddUint64(&metrics.buckets[bucket], 1)
+}
+
+/* serve /metrics on addr in the prometheus text format */
+func serveMetrics(addr string, stack *StorageStack) {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    writeMetrics(w, stack)
+  })
+  logger.Printf("Serving metrics on %s", addr)
+  listener, err := listenRetrying("tcp", addr)
+  if err != nil {
+    logger.Fatalf("Unable to serve metrics on %s: %s", addr, err)
+  }
+  http.Serve(listener, mux)
+}
+
+func metricHeader(w io.Writer, name string, kind string, help string) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func seconds(nanos uint64) string {
+  return strconv.Ftoa64(float64(nanos) / 1e9, 'g', -1)
+}
+
+/* storages able to report how much they hold */
+type usageReporter interface {
+  usage() (items int, bytes int64)
+}
+
+func writeMetrics(w io.Writer, stack *StorageStack) {
+  var names []string
+  for name, _ := range commandMetrics {
+    names = append(names, name)
+  }
+  sort.SortStrings(names)
+
+  metricHeader(w, "gocached_commands_total", "counter", "Commands processed.")
+  for _, name := range names {
+    fmt.Fprintf(w, "gocached_commands_total{command=%q} %d\n", name, atomic.LoadUint64(&commandMetrics[name].count))
+  }
+  metricHeader(w, "gocached_command_duration_seconds", "histogram", "Time taken to process commands.")
+  for _, name := range names {
+    metrics := commandMetrics[name]
+    cumulative := uint64(0)
+    for i, bound := range latencyBuckets {
+      cumulative += atomic.LoadUint64(&metrics.buckets[i])
+      fmt.Fprintf(w, "gocached_command_duration_seconds_bucket{command=%q,le=\"%s\"} %d\n", name, seconds(uint64(bound)), cumulative)
+    }
+    cumulative += atomic.LoadUint64(&metrics.buckets[len(latencyBuckets)])
+    fmt.Fprintf(w, "gocached_command_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", name, cumulative)
+    fmt.Fprintf(w, "gocached_command_duration_seconds_sum{command=%q} %s\n", name, seconds(atomic.LoadUint64(&metrics.nanos)))
+    fmt.Fprintf(w, "gocached_command_duration_seconds_count{command=%q} %d\n", name, cumulative)
+  }
+
+  hits, misses := atomic.LoadUint64(&serverStats.getHits), atomic.LoadUint64(&serverStats.getMisses)
+  ratio := 0.0
+  if hits + misses > 0 {
+    ratio = float64(hits) / float64(hits + misses)
+  }
+  metricHeader(w, "gocached_hit_ratio", "gauge", "Fraction of retrieved keys that were found.")
+  fmt.Fprintf(w, "gocached_hit_ratio %s\n", strconv.Ftoa64(ratio, 'g', -1))
+
+  // every numeric general statistic, as the stats command reports them
+  for _, stat := range serverStats.general() {
+    if _, err := strconv.Atof64(stat.value); err == nil {
+      metricHeader(w, "gocached_" + stat.name, "untyped", "The " + stat.name + " statistic.")
+      fmt.Fprintf(w, "gocached_%s %s\n", stat.name, stat.value)
+    }
+  }
+
+  metricHeader(w, "gocached_partition_items", "gauge", "Items stored per storage partition.")
+  for i, partition := range stack.partitions {
+    if reporter, ok := partition.(usageReporter); ok {
+      items, _ := reporter.usage()
+      fmt.Fprintf(w, "gocached_partition_items{partition=\"%d\"} %d\n", i, items)
+    }
+  }
+  metricHeader(w, "gocached_partition_bytes", "gauge", "Bytes of item data stored per storage partition.")
+  for i, partition := range stack.partitions {
+    if reporter, ok := partition.(usageReporter); ok {
+      _, bytes := reporter.usage()
+      fmt.Fprintf(w, "gocached_partition_bytes{partition=\"%d\"} %d\n", i, bytes)
+    }
+  }
+
+  if stack.generational != nil {
+    generations, pending := stack.generational.stats()
+    metricHeader(w, "gocached_generations", "gauge", "Generations tracking item expirations.")
+    fmt.Fprintf(w, "gocached_generations %d\n", generations)
+    metricHeader(w, "gocached_pending_expirations", "gauge", "Items waiting for their generation to be collected.")
+    fmt.Fprintf(w, "gocached_pending_expirations %d\n", pending)
+  }
+  if stack.updatesChannel != nil {
+    metricHeader(w, "gocached_updates_channel_depth", "gauge", "Storage updates waiting to be processed.")
+    fmt.Fprintf(w, "gocached_updates_channel_depth %d\n", len(stack.updatesChannel))
+  }
+}
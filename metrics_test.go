@@ -0,0 +1,23 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+func TestMetricsReportPartitions(t *testing.T) {
+
+  memory := newMemoryLimit(0)
+  stack := newStorageStack(newHashingStorage(2, func() CacheStorage { return newMapCacheStorage(memory, nil) }))
+  stack.storage.Set("foo", 0, 0, 3, []byte("bar"))
+  observeCommand("get", 0)
+
+  var buffer bytes.Buffer
+  writeMetrics(&buffer, stack)
+  metrics := buffer.String()
+
+  assertEquals(t, strings.Contains(metrics, "gocached_partition_items{partition=\"1\"}"), true, "partition items not reported")
+  assertEquals(t, strings.Contains(metrics, "gocached_command_duration_seconds_bucket{command=\"get\",le=\"+Inf\"}"), true, "latency histogram not reported")
+  assertEquals(t, strings.Contains(metrics, "gocached_hit_ratio"), true, "hit ratio not reported")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+  "io"
+  "os"
+  "bufio"
+)
+
+/* Replies are buffered per session and written before the session reads
+   from the client again, or when the buffer fills up, so a pipeline of gets
+   already received costs a single write and no reply waits on a command
+   the client hasn't finished sending. Values of largeValueSize bytes
+   or more aren't copied into the buffer, it is flushed and they are
+   written on their own. The Go release this builds with has neither writev
+   nor net.Buffers, so such a value takes one write besides the one of its
+   header */
+
+/* bytes of replies buffered per session, set by -output-buffer */
+var outputBufferSize = 16384
+
+const largeValueSize = 4096
+
+/* the source of a session's reader, writing the buffered replies before
+   reading from the client, which may wait for it */
+type flushingReader struct {
+  conn   io.Reader
+  output *bufio.Writer
+}
+
+func (self *flushingReader) Read(b []byte) (int, os.Error) {
+  if err := self.output.Flush(); err != nil {
+    return 0, err
+  }
+  return self.conn.Read(b)
+}
+
+/* write what is buffered to the client */
+func (s *Session) flush() {
+  if s.output != nil {
+    s.output.Flush()
+  }
+}
+
+/* write a value, only valid during the call, to the client */
+func (s *Session) writeValue(value []byte) {
+  if s.output == nil || len(value) < largeValueSize {
+    s.writer.Write(value)
+  } else if s.output.Flush() == nil {
+    s.conn.Write(value)
+  }
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+  "os"
+  "net"
+  "bytes"
+  "strings"
+  "testing"
+)
+
+/* a connection replaying input and counting the writes made to it */
+type recordingConn struct {
+  input  *bytes.Buffer
+  output bytes.Buffer
+  writes int
+}
+
+func (self *recordingConn) Read(b []byte) (int, os.Error)  { return self.input.Read(b) }
+func (self *recordingConn) Write(b []byte) (int, os.Error) { self.writes++; return self.output.Write(b) }
+func (self *recordingConn) Close() os.Error                { return nil }
+func (self *recordingConn) LocalAddr() net.Addr            { return nil }
+func (self *recordingConn) RemoteAddr() net.Addr           { return nil }
+func (self *recordingConn) SetTimeout(ns int64) os.Error      { return nil }
+func (self *recordingConn) SetReadTimeout(ns int64) os.Error  { return nil }
+func (self *recordingConn) SetWriteTimeout(ns int64) os.Error { return nil }
+
+func TestPipelinedGetsAreWrittenOnce(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("aaa", 0, 0, 3, []byte("aaa"))
+  storage.Set("bbb", 0, 0, 3, []byte("bbb"))
+  conn := &recordingConn{input: bytes.NewBufferString("get aaa bbb\r\nget bbb\r\nget ccc\r\n")}
+
+  session, _ := NewSession(conn, storage)
+  session.serve()
+  assertEquals(t, conn.writes, 1, "pipelined replies not coalesced")
+  assertEquals(t, conn.output.String(),
+               "VALUE aaa 0 3\r\naaa\r\nVALUE bbb 0 3\r\nbbb\r\nEND\r\nVALUE bbb 0 3\r\nbbb\r\nEND\r\nEND\r\n",
+               "wrong replies")
+}
+
+func TestLargeValuesBypassTheBuffer(t *testing.T) {
+
+  value := strings.Repeat("x", largeValueSize)
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("big", 0, 0, uint32(len(value)), []byte(value))
+  conn := &recordingConn{input: bytes.NewBufferString("get big\r\n")}
+
+  session, _ := NewSession(conn, storage)
+  session.serve()
+  assertEquals(t, conn.writes, 3, "large value not written on its own")
+  assertEquals(t, conn.output.String(), "VALUE big 0 4096\r\n" + value + "\r\nEND\r\n", "wrong reply")
+}
+
+/* a connection handing out a chunk per read, keeping what had been written
+   to it when each read was made */
+type chunkedConn struct {
+  recordingConn
+  chunks  []string
+  written []string
+}
+
+func (self *chunkedConn) Read(b []byte) (int, os.Error) {
+  self.written = append(self.written, self.output.String())
+  if len(self.chunks) == 0 {
+    return 0, os.EOF
+  }
+  n := copy(b, self.chunks[0])
+  self.chunks = self.chunks[1:]
+  return n, nil
+}
+
+func TestRepliesAreWrittenBeforeWaitingForThePartOfACommand(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  storage.Set("aaa", 0, 0, 3, []byte("aaa"))
+  for _, chunks := range [][]string{
+    {"get aaa\r\nset b", "bb 0 0 3\r\nbbb\r\n"},
+    {"get aaa\r\nset bbb 0 0 3\r\nb", "bb\r\n"},
+  } {
+    conn := &chunkedConn{chunks: chunks}
+    session, _ := NewSession(conn, storage)
+    session.serve()
+    assertEquals(t, len(conn.written) > 1 && conn.written[1] == "VALUE aaa 0 3\r\naaa\r\nEND\r\n", true,
+                 "reply held while waiting for " + chunks[1])
+    assertEquals(t, conn.output.String(), "VALUE aaa 0 3\r\naaa\r\nEND\r\nSTORED\r\n", "wrong replies")
+  }
+}
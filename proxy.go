@@ -0,0 +1,418 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+  "json"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "sync/atomic"
+  "client"
+)
+
+/* Proxy mode forwards text protocol requests to pools of memcached servers.
+   The configuration is a json file such as
+
+   {
+     "pools": {
+       "main":    ["10.0.0.1:11211", "10.0.0.2:11211"],
+       "replica": ["10.0.1.1:11211", "10.0.1.2:11211"],
+       "backup":  ["10.0.2.1:11211"],
+       "canary":  ["10.0.3.1:11211"]
+     },
+     "routes": [
+       {"prefix": "session:", "pools": ["main", "replica"], "failover": "backup"},
+       {"prefix": "", "pools": ["main"], "shadow": "canary"}
+     ]
+   }
+
+   Keys take the route with the longest matching prefix. Writes go to every
+   pool of the route and reads to one of them, moving on to the next pool and
+   then to the failover pool while they are unavailable. Shadow pools get a
+   copy of every request and their replies are ignored. Cas values come from
+   the pool a read was served by, so cas only succeeds on that replica */
+
+type proxyConfig struct {
+  Pools  map[string][]string
+  Routes []struct {
+    Prefix   string
+    Pools    []string
+    Failover string
+    Shadow   string
+  }
+}
+
+/* the upstream connection manager, one client with its connection pools per
+   configured pool shared by every route using it */
+type ProxyPool struct {
+  name   string
+  client *client.Client
+}
+
+type ProxyRoute struct {
+  prefix   string
+  pools    []*ProxyPool
+  failover *ProxyPool
+  shadow   *ProxyPool
+  next     uint32 // replica the next read starts at
+}
+
+/* set when running as a proxy, nil otherwise */
+var proxyRouter *Router
+
+type Router struct {
+  pools  map[string]*ProxyPool
+  routes []*ProxyRoute // longest prefixes first
+}
+
+type byPrefixLength []*ProxyRoute
+
+func (self byPrefixLength) Len() int           { return len(self) }
+func (self byPrefixLength) Less(i, j int) bool { return len(self[i].prefix) > len(self[j].prefix) }
+func (self byPrefixLength) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func loadRouter(path string, timeout int64) (*Router, os.Error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var config proxyConfig
+  if err := json.Unmarshal(data, &config); err != nil {
+    return nil, err
+  }
+  router := &Router{pools: make(map[string]*ProxyPool)}
+  for name, servers := range config.Pools {
+    pool := &ProxyPool{name, client.New(servers...)}
+    pool.client.Timeout = timeout
+    router.pools[name] = pool
+  }
+  lookup := func(name string) (*ProxyPool, os.Error) {
+    if name == "" {
+      return nil, nil
+    } else if pool, present := router.pools[name]; present {
+      return pool, nil
+    }
+    return nil, os.NewError("Unknown proxy pool " + name)
+  }
+  for _, routeConfig := range config.Routes {
+    route := &ProxyRoute{prefix: routeConfig.Prefix}
+    for _, name := range routeConfig.Pools {
+      pool, err := lookup(name)
+      if err != nil {
+        return nil, err
+      }
+      route.pools = append(route.pools, pool)
+    }
+    if len(route.pools) == 0 {
+      return nil, os.NewError("Proxy route without pools: " + route.prefix)
+    } else if route.failover, err = lookup(routeConfig.Failover); err != nil {
+      return nil, err
+    } else if route.shadow, err = lookup(routeConfig.Shadow); err != nil {
+      return nil, err
+    }
+    router.routes = append(router.routes, route)
+  }
+  sort.Sort(byPrefixLength(router.routes))
+  return router, nil
+}
+
+func (self *Router) route(key string) *ProxyRoute {
+  for _, route := range self.routes {
+    if strings.HasPrefix(key, route.prefix) {
+      return route
+    }
+  }
+  return nil
+}
+
+/* run f on the shadow pool, if any, without waiting for it */
+func (self *ProxyRoute) mirror(f func(pool *ProxyPool) os.Error) {
+  if self.shadow != nil {
+    go f(self.shadow)
+  }
+}
+
+/* run f on one pool, trying the others while they are unavailable */
+func (self *ProxyRoute) read(f func(pool *ProxyPool) os.Error) os.Error {
+  self.mirror(f)
+  start := int(atomic.AddUint32(&self.next, 1))
+  var err os.Error
+  for i := 0; i < len(self.pools); i++ {
+    if err = f(self.pools[(start + i) % len(self.pools)]); !client.IsUnavailable(err) {
+      return err
+    }
+  }
+  if self.failover != nil {
+    err = f(self.failover)
+  }
+  return err
+}
+
+/* run f on every pool, the reply is the one of the first pool answering */
+func (self *ProxyRoute) write(f func(pool *ProxyPool) os.Error) os.Error {
+  self.mirror(f)
+  errs := make([]os.Error, len(self.pools))
+  var wait sync.WaitGroup
+  for i, pool := range self.pools {
+    wait.Add(1)
+    go func(i int, pool *ProxyPool) {
+      errs[i] = f(pool)
+      wait.Done()
+    }(i, pool)
+  }
+  wait.Wait()
+  for _, err := range errs {
+    if !client.IsUnavailable(err) {
+      return err
+    }
+  }
+  if self.failover != nil {
+    return f(self.failover)
+  }
+  return errs[0]
+}
+
+/* serve text protocol requests from the routes, parsing them as CommandLoop
+   does */
+func (s *Session) ProxyLoop(router *Router) {
+  for line := getTokenizedLine(s.bufreader);
+      line != nil && s.begin(); line = getTokenizedLine(s.bufreader) {
+
+    if !s.authenticated() {
+      s.textAuthentication(line)
+      if !s.end() {
+        return
+      }
+      continue
+    }
+
+    start := time.Nanoseconds()
+    switch line[0] {
+
+    case "set", "add", "replace", "append", "prepend", "cas":
+      if cmd := (&StorageCommand{session: s}); cmd.parse(line) && s.mayWrite(cmd.key) {
+        router.store(cmd)
+      }
+    case "get", "gets", "gat", "gats":
+      if cmd := (&RetrievalCommand{session: s}); cmd.parse(line) && cmd.allowed() {
+        router.retrieve(cmd)
+      }
+    case "delete":
+      if cmd := (&DeleteCommand{session: s}); cmd.parse(line) && s.mayWrite(cmd.key) {
+        router.delete(cmd)
+      }
+    case "touch":
+      if cmd := (&TouchCommand{session: s}); cmd.parse(line) && s.mayWrite(cmd.key) {
+        router.touch(cmd)
+      }
+    case "incr", "decr":
+      if cmd := (&ArithmeticCommand{session: s}); cmd.parse(line) && s.mayReadWrite(cmd.key) {
+        router.arithmetic(cmd)
+      }
+    case "stats":
+      if cmd := (&StatsCommand{session: s}); cmd.parse(line) && (len(cmd.args) == 0 || s.mayAdminister()) {
+        cmd.Exec()
+      }
+    case "version", "quit":
+
+    default:
+      Error(s, UnkownCommand, "")
+    }
+    observeCommand(line[0], start)
+    if !s.end() {
+      return
+    }
+  }
+}
+
+/* write the reply for err, or success when err is nil */
+func proxyReply(s *Session, err os.Error, success string, noreply bool) {
+  var reply string
+  switch err {
+  case nil:
+    reply = success
+  case client.ErrCacheMiss:
+    reply = "NOT_FOUND"
+  case client.ErrNotStored:
+    reply = "NOT_STORED"
+  case client.ErrCasConflict:
+    reply = "EXISTS"
+  default:
+    if serverError, ok := err.(client.ServerError); ok {
+      reply = string(serverError)
+    } else {
+      reply = "SERVER_ERROR " + err.String()
+    }
+  }
+  if !noreply {
+    s.writer.Write([]byte(reply + "\r\n"))
+  }
+}
+
+func (self *Router) routeOrError(s *Session, key string) *ProxyRoute {
+  route := self.route(key)
+  if route == nil {
+    Error(s, ServerError, "no route for key")
+  }
+  return route
+}
+
+func (self *Router) store(cmd *StorageCommand) {
+  atomic.AddUint64(&serverStats.cmdSet, 1)
+  route := self.routeOrError(cmd.session, cmd.key)
+  if route == nil {
+    return
+  }
+  // the data block is reused by the session, shadow requests outlive it
+  data := make([]byte, len(cmd.data))
+  copy(data, cmd.data)
+  item := &client.Item{Key: cmd.key, Value: data, Flags: cmd.flags, Expiration: int32(cmd.exptime), Cas: cmd.cas_unique}
+  err := route.write(func(pool *ProxyPool) os.Error {
+    switch cmd.command {
+    case "add":
+      return pool.client.Add(item)
+    case "replace":
+      return pool.client.Replace(item)
+    case "append":
+      return pool.client.Append(item)
+    case "prepend":
+      return pool.client.Prepend(item)
+    case "cas":
+      return pool.client.Cas(item)
+    }
+    return pool.client.Set(item)
+  })
+  if err == client.ErrCacheMiss && cmd.command != "cas" {
+    err = client.ErrNotStored
+  }
+  proxyReply(cmd.session, err, "STORED", cmd.noreply)
+}
+
+/* touch every key at once, unavailable when any of their servers is */
+func (self *ProxyPool) touchAll(keys []string, exptime int32) os.Error {
+  errs := make([]os.Error, len(keys))
+  var wait sync.WaitGroup
+  for i, key := range keys {
+    wait.Add(1)
+    go func(i int, key string) {
+      errs[i] = self.client.Touch(key, exptime)
+      wait.Done()
+    }(i, key)
+  }
+  wait.Wait()
+  for _, err := range errs {
+    if client.IsUnavailable(err) {
+      return err
+    }
+  }
+  return nil
+}
+
+/* fan the keys out to their routes, one request per pool, and reply with
+   the values in the order they were asked for */
+func (self *Router) retrieve(cmd *RetrievalCommand) {
+  var writer = cmd.session.writer
+  touch := cmd.command == "gat" || cmd.command == "gats"
+  groups := make(map[*ProxyRoute][]string)
+  for _, key := range cmd.keys {
+    if route := self.routeOrError(cmd.session, key); route == nil {
+      return
+    } else {
+      groups[route] = append(groups[route], key)
+    }
+  }
+
+  var lock sync.Mutex
+  var wait sync.WaitGroup
+  found := make(map[string]*client.Item)
+  for route, keys := range groups {
+    wait.Add(1)
+    go func(route *ProxyRoute, keys []string) {
+      defer wait.Done()
+      if touch {
+        route.write(func(pool *ProxyPool) os.Error { return pool.touchAll(keys, int32(cmd.exptime)) })
+      }
+      route.read(func(pool *ProxyPool) os.Error {
+        items, err := pool.client.GetMulti(keys)
+        if !client.IsUnavailable(err) && pool != route.shadow {
+          lock.Lock()
+          for key, item := range items {
+            found[key] = item
+          }
+          lock.Unlock()
+        }
+        return err
+      })
+    }(route, keys)
+  }
+  wait.Wait()
+
+  showAll := cmd.command == "gets" || cmd.command == "gats"
+  for _, key := range cmd.keys {
+    item, present := found[key]
+    atomic.AddUint64(&serverStats.cmdGet, 1)
+    serverStats.hit(&serverStats.getHits, &serverStats.getMisses, present)
+    if !present {
+      continue
+    }
+    if showAll {
+      writer.Write([]byte(fmt.Sprintf("VALUE %s %d %d %d\r\n", key, item.Flags, len(item.Value), item.Cas)))
+    } else {
+      writer.Write([]byte(fmt.Sprintf("VALUE %s %d %d\r\n", key, item.Flags, len(item.Value))))
+    }
+    cmd.session.writeValue(item.Value)
+    writer.Write([]byte("\r\n"))
+  }
+  writer.Write([]byte("END\r\n"))
+}
+
+func (self *Router) delete(cmd *DeleteCommand) {
+  if route := self.routeOrError(cmd.session, cmd.key); route != nil {
+    err := route.write(func(pool *ProxyPool) os.Error { return pool.client.Delete(cmd.key) })
+    proxyReply(cmd.session, err, "DELETED", cmd.noreply)
+  }
+}
+
+func (self *Router) touch(cmd *TouchCommand) {
+  atomic.AddUint64(&serverStats.cmdTouch, 1)
+  if route := self.routeOrError(cmd.session, cmd.key); route != nil {
+    err := route.write(func(pool *ProxyPool) os.Error { return pool.client.Touch(cmd.key, int32(cmd.exptime)) })
+    proxyReply(cmd.session, err, "TOUCHED", cmd.noreply)
+  }
+}
+
+func (self *Router) arithmetic(cmd *ArithmeticCommand) {
+  route := self.routeOrError(cmd.session, cmd.key)
+  if route == nil {
+    return
+  }
+  var lock sync.Mutex
+  values := make(map[*ProxyPool]uint64)
+  err := route.write(func(pool *ProxyPool) os.Error {
+    var value uint64
+    var err os.Error
+    if cmd.command == "incr" {
+      value, err = pool.client.Incr(cmd.key, cmd.value)
+    } else {
+      value, err = pool.client.Decr(cmd.key, cmd.value)
+    }
+    if err == nil && pool != route.shadow {
+      lock.Lock()
+      values[pool] = value
+      lock.Unlock()
+    }
+    return err
+  })
+  // reply with the value of the pool write took its reply from
+  value := values[route.failover]
+  for i := len(route.pools) - 1; i >= 0; i-- {
+    if result, found := values[route.pools[i]]; found {
+      value = result
+    }
+  }
+  proxyReply(cmd.session, err, strconv.Uitoa64(value), cmd.noreply)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "net"
+  "bytes"
+  "testing"
+  "client"
+)
+
+func TestProxyRoutesByLongestPrefix(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test_proxy.json"
+  defer os.Remove(path)
+  ioutil.WriteFile(path, []byte(`{
+    "pools": {"main": ["127.0.0.1:11211"], "sessions": ["127.0.0.1:11212"]},
+    "routes": [
+      {"prefix": "", "pools": ["main"]},
+      {"prefix": "session:", "pools": ["sessions", "main"], "failover": "main"}
+    ]
+  }`), 0644)
+
+  router, err := loadRouter(path, 1e9)
+  assertEquals(t, err == nil, true, "configuration not loaded")
+  assertEquals(t, router.route("session:1").pools[0].name, "sessions", "longest prefix not preferred")
+  assertEquals(t, router.route("session:1").failover.name, "main", "failover pool not set")
+  assertEquals(t, router.route("user:1").pools[0].name, "main", "catch all route not used")
+}
+
+func TestProxyRejectsUnknownPools(t *testing.T) {
+
+  path := os.TempDir() + "/gocached_test_proxy.json"
+  defer os.Remove(path)
+  ioutil.WriteFile(path, []byte(`{"pools": {}, "routes": [{"prefix": "", "pools": ["missing"]}]}`), 0644)
+
+  _, err := loadRouter(path, 1e9)
+  assertEquals(t, err != nil, true, "unknown pool accepted")
+}
+
+/* a pool of one in-process server with a storage of its own */
+func testPool(t *testing.T, name string) (*ProxyPool, CacheStorage, net.Listener) {
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      go func() {
+        defer conn.Close()
+        if session, err := NewSession(conn, storage); err == nil {
+          session.serve()
+        }
+      }()
+    }
+  }()
+  return &ProxyPool{name, client.New(listener.Addr().String())}, storage, listener
+}
+
+/* a pool whose only server refuses connections */
+func deadPool(t *testing.T, name string) *ProxyPool {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  addr := listener.Addr().String()
+  listener.Close()
+  return &ProxyPool{name, client.New(addr)}
+}
+
+/* the replies of the router to requests */
+func proxied(router *Router, requests string) string {
+  conn := &recordingConn{input: bytes.NewBufferString(requests)}
+  session, _ := NewSession(conn, newMapCacheStorage(newMemoryLimit(0), nil))
+  session.ProxyLoop(router)
+  session.flush()
+  return conn.output.String()
+}
+
+func TestProxyWritesToEveryPool(t *testing.T) {
+
+  primary, primaryStorage, primaryListener := testPool(t, "main")
+  defer primaryListener.Close()
+  replica, replicaStorage, replicaListener := testPool(t, "replica")
+  defer replicaListener.Close()
+  router := &Router{routes: []*ProxyRoute{&ProxyRoute{prefix: "", pools: []*ProxyPool{primary, replica}}}}
+
+  assertEquals(t, proxied(router, "set foo 0 0 3\r\nbar\r\n"), "STORED\r\n", "wrong set reply")
+  assertEquals(t, holds(primaryStorage, "foo", "bar")(), true, "first pool not written")
+  assertEquals(t, holds(replicaStorage, "foo", "bar")(), true, "second pool not written")
+
+  assertEquals(t, proxied(router, "gat 100 foo\r\n"), "VALUE foo 0 3\r\nbar\r\nEND\r\n", "wrong gat reply")
+  for _, storage := range []CacheStorage{primaryStorage, replicaStorage} {
+    _, entry := storage.Get("foo")
+    assertEquals(t, entry != nil && entry.exptime != 0, true, "gat didn't touch every pool")
+  }
+
+  assertEquals(t, proxied(router, "delete foo\r\ndelete foo\r\n"), "DELETED\r\nNOT_FOUND\r\n", "wrong delete replies")
+  assertEquals(t, holds(replicaStorage, "foo", "bar")(), false, "second pool not deleted from")
+}
+
+func TestProxyReadsFailOver(t *testing.T) {
+
+  primary, primaryStorage, primaryListener := testPool(t, "main")
+  defer primaryListener.Close()
+  backup, backupStorage, backupListener := testPool(t, "backup")
+  defer backupListener.Close()
+  primaryStorage.Set("foo", 0, 0, 4, []byte("main"))
+  backupStorage.Set("foo", 0, 0, 6, []byte("backup"))
+
+  // reads start at every pool in turn, the dead one is always skipped
+  router := &Router{routes: []*ProxyRoute{&ProxyRoute{prefix: "", pools: []*ProxyPool{deadPool(t, "dead"), primary}}}}
+  for i := 0; i < 2; i++ {
+    assertEquals(t, proxied(router, "get foo\r\n"), "VALUE foo 0 4\r\nmain\r\nEND\r\n", "read not moved to the next pool")
+  }
+
+  router = &Router{routes: []*ProxyRoute{&ProxyRoute{prefix: "", pools: []*ProxyPool{deadPool(t, "dead")}, failover: backup}}}
+  assertEquals(t, proxied(router, "get foo\r\n"), "VALUE foo 0 6\r\nbackup\r\nEND\r\n", "read not moved to the failover pool")
+  assertEquals(t, proxied(router, "set bar 0 0 1\r\nx\r\n"), "STORED\r\n", "write not moved to the failover pool")
+}
+
+func TestProxyShadowIsIgnored(t *testing.T) {
+
+  primary, primaryStorage, primaryListener := testPool(t, "main")
+  defer primaryListener.Close()
+  canary, canaryStorage, canaryListener := testPool(t, "canary")
+  defer canaryListener.Close()
+  canaryStorage.Set("foo", 0, 0, 6, []byte("canary"))
+  router := &Router{routes: []*ProxyRoute{&ProxyRoute{prefix: "", pools: []*ProxyPool{primary}, shadow: canary}}}
+
+  assertEquals(t, proxied(router, "get foo\r\n"), "END\r\n", "shadow value served")
+  assertEquals(t, proxied(router, "set bar 0 0 1\r\nx\r\n"), "STORED\r\n", "wrong set reply")
+  assertEquals(t, holds(primaryStorage, "bar", "x")(), true, "pool not written")
+  assertEquals(t, eventually(holds(canaryStorage, "bar", "x")), true, "shadow not written")
+
+  router = &Router{routes: []*ProxyRoute{&ProxyRoute{prefix: "", pools: []*ProxyPool{primary}, shadow: deadPool(t, "dead")}}}
+  assertEquals(t, proxied(router, "set bar 0 0 1\r\ny\r\nget bar\r\n"), "STORED\r\nVALUE bar 0 1\r\ny\r\nEND\r\n", "dead shadow failed requests")
+}
+
+func TestProxyMergesMultiGets(t *testing.T) {
+
+  primary, primaryStorage, primaryListener := testPool(t, "main")
+  defer primaryListener.Close()
+  users, usersStorage, usersListener := testPool(t, "users")
+  defer usersListener.Close()
+  primaryStorage.Set("a", 0, 0, 1, []byte("1"))
+  primaryStorage.Set("b", 0, 0, 1, []byte("2"))
+  usersStorage.Set("user:a", 0, 0, 1, []byte("3"))
+  router := &Router{routes: []*ProxyRoute{
+    &ProxyRoute{prefix: "user:", pools: []*ProxyPool{users}},
+    &ProxyRoute{prefix: "", pools: []*ProxyPool{primary}},
+  }}
+
+  assertEquals(t, proxied(router, "get b user:a missing a\r\n"),
+               "VALUE b 0 1\r\n2\r\nVALUE user:a 0 1\r\n3\r\nVALUE a 0 1\r\n1\r\nEND\r\n",
+               "values not merged in the order asked for")
+}
+
+func TestProxyReplies(t *testing.T) {
+
+  for _, test := range []struct {
+    err     os.Error
+    noreply bool
+    reply   string
+  }{
+    {nil, false, "STORED\r\n"},
+    {nil, true, ""},
+    {client.ErrCacheMiss, false, "NOT_FOUND\r\n"},
+    {client.ErrNotStored, false, "NOT_STORED\r\n"},
+    {client.ErrCasConflict, false, "EXISTS\r\n"},
+    {client.ServerError("SERVER_ERROR out of memory"), false, "SERVER_ERROR out of memory\r\n"},
+    {client.ErrNoServers, false, "SERVER_ERROR " + client.ErrNoServers.String() + "\r\n"},
+  } {
+    conn := &recordingConn{input: bytes.NewBuffer(nil)}
+    session, _ := NewSession(conn, nil)
+    proxyReply(session, test.err, "STORED", test.noreply)
+    session.flush()
+    assertEquals(t, conn.output.String(), test.reply, "wrong reply for " + test.reply)
+  }
+}
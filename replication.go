@@ -0,0 +1,352 @@
+package main
+
+import (
+  "os"
+  "io"
+  "net"
+  "bufio"
+  "bytes"
+  "sync"
+  "time"
+  "strings"
+  "sync/atomic"
+  "crypto/subtle"
+)
+
+/* Replication streams journal records from a leader to its followers. A
+   follower connects and sends "SYNC\r\n", or "SYNC <secret>\r\n" when the
+   leader was given -replication-secret, the leader answers with a journal
+   header, a flush record and a set record for every live entry, then keeps
+   sending the records of the mutations it applies. Followers that can't keep
+   up are disconnected and resync when they reconnect */
+
+const replicationQueueLength = 10000
+
+/* a mutation as replicated to followers, carrying the value UpdateMessage
+   lacks. entry holds only what the operation needs */
+type MutationEvent struct {
+  op    byte
+  key   string
+  entry *StorageEntry
+}
+
+func (self *MutationEvent) encode() []byte {
+  return encodeJournalRecord(self.op, self.key, self.entry)
+}
+
+/* read the next record written by encodeJournalRecord, verifying its checksum */
+func readMutationEvent(r *bufio.Reader) (*MutationEvent, os.Error) {
+  op, err := r.ReadByte()
+  if err != nil {
+    return nil, err
+  }
+  key, entry, err := readEntry(r)
+  if err != nil {
+    return nil, err
+  }
+  event := &MutationEvent{op, key, entry}
+  sum := make([]byte, 4)
+  if _, err := io.ReadFull(r, sum); err != nil {
+    return nil, err
+  }
+  if encoded := event.encode(); !bytes.Equal(encoded[len(encoded)-4:], sum) {
+    return nil, os.NewError("Corrupted replication record")
+  }
+  return event, nil
+}
+
+/* Sends every successful mutation to the connected followers. Mutations run
+   under a single lock so followers see them in the order they were applied */
+type ReplicatingStorage struct {
+  storage   CacheStorage
+  lock      sync.Mutex
+  followers map[chan []byte]bool
+  secret    string // followers must send, empty to accept any
+}
+
+func newReplicatingStorage(storage CacheStorage, secret string) *ReplicatingStorage {
+  return &ReplicatingStorage{storage: storage, followers: make(map[chan []byte]bool), secret: secret}
+}
+
+/* queue a mutation for every follower. Must hold the lock */
+func (self *ReplicatingStorage) replicate(op byte, key string, entry *StorageEntry) {
+  if len(self.followers) == 0 {
+    return
+  }
+  record := (&MutationEvent{op, key, entry}).encode()
+  for queue, _ := range self.followers {
+    select {
+    case queue <- record:
+    default:
+      logger.Println("Dropping a follower that can't keep up with replication")
+      self.followers[queue] = false, false
+      close(queue)
+    }
+  }
+}
+
+func (self *ReplicatingStorage) replicateSet(key string, flags uint32, exptime uint32, content []byte) {
+  self.replicate(journalSet, key, newStorageEntry(exptime, flags, uint32(len(content)), 0, content))
+}
+
+/* accept followers on listener */
+func (self *ReplicatingStorage) serve(listener net.Listener) {
+  for {
+    if conn, err := listener.Accept(); err != nil {
+      logger.Println("An error ocurred accepting a new follower")
+    } else {
+      go self.follower(conn)
+    }
+  }
+}
+
+/* send a full sync to a follower and then the mutations following it */
+func (self *ReplicatingStorage) follower(conn net.Conn) {
+  defer conn.Close()
+  reader := bufio.NewReader(conn)
+  line, err := reader.ReadString('\n')
+  fields := strings.Fields(line)
+  if err != nil || len(fields) == 0 || len(fields) > 2 || fields[0] != "SYNC" {
+    logger.Printf("Unexpected replication request from %s", conn.RemoteAddr())
+    return
+  }
+  secret := ""
+  if len(fields) == 2 {
+    secret = fields[1]
+  }
+  if subtle.ConstantTimeCompare([]byte(secret), []byte(self.secret)) != 1 {
+    logger.Printf("Refusing follower %s, wrong replication secret", conn.RemoteAddr())
+    return
+  }
+
+  // the copy of the keyspace and the registration happen under the lock so
+  // no mutation is lost or sent twice
+  var full bytes.Buffer
+  queue := make(chan []byte, replicationQueueLength)
+  self.lock.Lock()
+  full.Write(journalHeader(0))
+  full.Write(encodeJournalRecord(journalFlush, "", &StorageEntry{}))
+  self.storage.Walk(func(key string, entry *StorageEntry) {
+    full.Write(encodeJournalRecord(journalSet, key, entry))
+  })
+  self.followers[queue] = true
+  self.lock.Unlock()
+  logger.Printf("Follower %s joined, sending %d bytes of full sync", conn.RemoteAddr(), full.Len())
+
+  writer := bufio.NewWriter(conn)
+  _, err = writer.Write(full.Bytes())
+  for err == nil {
+    record, ok := <-queue
+    if !ok {
+      return
+    }
+    _, err = writer.Write(record)
+    // batch whatever else is already queued into the same write
+    for pending := len(queue); pending > 0 && err == nil; pending-- {
+      if record, ok = <-queue; ok {
+        _, err = writer.Write(record)
+      }
+    }
+    if err == nil {
+      err = writer.Flush()
+    }
+  }
+  logger.Printf("Follower %s left: %s", conn.RemoteAddr(), err)
+  self.lock.Lock()
+  if self.followers[queue] {
+    self.followers[queue] = false, false
+    close(queue)
+  }
+  self.lock.Unlock()
+}
+
+func (self *ReplicatingStorage) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (*StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous, updated := self.storage.Set(key, flags, exptime, bytes, content)
+  self.replicateSet(key, flags, exptime, content)
+  return previous, updated
+}
+
+func (self *ReplicatingStorage) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, updated := self.storage.Add(key, flags, exptime, bytes, content)
+  if err == Ok {
+    self.replicateSet(key, flags, exptime, content)
+  }
+  return err, updated
+}
+
+func (self *ReplicatingStorage) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Replace(key, flags, exptime, bytes, content)
+  if err == Ok {
+    self.replicateSet(key, flags, exptime, content)
+  }
+  return err, previous, updated
+}
+
+func (self *ReplicatingStorage) Append(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Append(key, bytes, content)
+  if err == Ok {
+    self.replicate(journalAppend, key, newStorageEntry(0, 0, bytes, 0, content))
+  }
+  return err, previous, updated
+}
+
+func (self *ReplicatingStorage) Prepend(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Prepend(key, bytes, content)
+  if err == Ok {
+    self.replicate(journalPrepend, key, newStorageEntry(0, 0, bytes, 0, content))
+  }
+  return err, previous, updated
+}
+
+func (self *ReplicatingStorage) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Cas(key, flags, exptime, bytes, cas_unique, content)
+  if err == Ok {
+    self.replicateSet(key, flags, exptime, content)
+  }
+  return err, previous, updated
+}
+
+func (self *ReplicatingStorage) Get(key string) (ErrorCode, *StorageEntry) {
+  return self.storage.Get(key)
+}
+
+func (self *ReplicatingStorage) Delete(key string) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, deleted := self.storage.Delete(key)
+  if err == Ok {
+    self.replicate(journalDelete, key, &StorageEntry{})
+  }
+  return err, deleted
+}
+
+func (self *ReplicatingStorage) Incr(key string, value uint64, incr bool) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Incr(key, value, incr)
+  if err == Ok {
+    self.replicateSet(key, updated.flags, updated.exptime, updated.content)
+  }
+  return err, previous, updated
+}
+
+func (self *ReplicatingStorage) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  err, previous, updated := self.storage.Touch(key, exptime)
+  if err == Ok {
+    self.replicate(journalTouch, key, &StorageEntry{exptime: exptime})
+  }
+  return err, previous, updated
+}
+
+func (self *ReplicatingStorage) Flush() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.storage.Flush()
+  self.replicate(journalFlush, "", &StorageEntry{})
+}
+
+func (self *ReplicatingStorage) Walk(f func(key string, entry *StorageEntry)) {
+  self.storage.Walk(f)
+}
+
+func (self *ReplicatingStorage) Expire(key string) {
+  self.storage.Expire(key)
+}
+
+/* the follower side, applying the leader's stream to storage */
+type Follower struct {
+  leader   string
+  storage  CacheStorage
+  secret   string
+  promoted int32
+  lock     sync.Mutex
+  conn     net.Conn
+}
+
+/* set when the server follows a leader, nil otherwise */
+var follower *Follower
+
+func newFollower(leader string, storage CacheStorage, secret string) *Follower {
+  return &Follower{leader: leader, storage: storage, secret: secret}
+}
+
+/* whether clients are denied writes */
+func (self *Follower) readOnly() bool {
+  return self != nil && atomic.LoadInt32(&self.promoted) == 0
+}
+
+/* stop following the leader and start accepting writes */
+func (self *Follower) Promote() bool {
+  if !atomic.CompareAndSwapInt32(&self.promoted, 0, 1) {
+    return false
+  }
+  self.lock.Lock()
+  if self.conn != nil {
+    self.conn.Close()
+  }
+  self.lock.Unlock()
+  logger.Printf("Promoted, no longer following %s", self.leader)
+  return true
+}
+
+/* follow the leader until promoted, reconnecting and resyncing on errors */
+func (self *Follower) run() {
+  for self.readOnly() {
+    if err := self.follow(); err != nil && self.readOnly() {
+      logger.Printf("Replication from %s interrupted: %s", self.leader, err)
+      time.Sleep(1e9)
+    }
+  }
+}
+
+func (self *Follower) follow() os.Error {
+  conn, err := net.Dial("tcp", self.leader)
+  if err != nil {
+    return err
+  }
+  self.lock.Lock()
+  self.conn = conn
+  self.lock.Unlock()
+  defer conn.Close()
+  if !self.readOnly() {
+    return nil
+  }
+
+  request := "SYNC\r\n"
+  if self.secret != "" {
+    request = "SYNC " + self.secret + "\r\n"
+  }
+  if _, err = io.WriteString(conn, request); err != nil {
+    return err
+  }
+  reader := bufio.NewReader(conn)
+  header := make([]byte, len(journalHeader(0)))
+  if _, err = io.ReadFull(reader, header); err != nil {
+    return err
+  } else if !bytes.Equal(header, journalHeader(0)) {
+    return os.NewError("Unsupported replication stream")
+  }
+  logger.Printf("Following %s", self.leader)
+  for {
+    event, err := readMutationEvent(reader)
+    if err != nil {
+      return err
+    }
+    applyJournalRecord(self.storage, event.op, event.key, event.entry)
+  }
+  return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "net"
+  "time"
+  "bufio"
+  "bytes"
+  "testing"
+)
+
+func TestMutationEventRoundTrip(t *testing.T) {
+
+  event := &MutationEvent{journalSet, "foo", newStorageEntry(0, 7, 3, 0, []byte("bar"))}
+  read, err := readMutationEvent(bufio.NewReader(bytes.NewBuffer(event.encode())))
+  assertEquals(t, err == nil, true, "event not read back")
+  assertEquals(t, read.key, "foo", "key not read back")
+  assertEquals(t, read.entry.flags, uint32(7), "flags not read back")
+  assertEquals(t, string(read.entry.content), "bar", "value not read back")
+
+  encoded := event.encode()
+  encoded[len(encoded) - 5] ^= 0xff
+  _, err = readMutationEvent(bufio.NewReader(bytes.NewBuffer(encoded)))
+  assertEquals(t, err != nil, true, "corrupted event read back")
+}
+
+/* poll condition for a few seconds, replication is asynchronous */
+func eventually(condition func() bool) bool {
+  for deadline := time.Nanoseconds() + 5e9; time.Nanoseconds() < deadline; time.Sleep(1e7) {
+    if condition() {
+      return true
+    }
+  }
+  return condition()
+}
+
+func holds(storage CacheStorage, key string, value string) func() bool {
+  return func() bool {
+    _, entry := storage.Get(key)
+    return entry != nil && string(entry.content) == value
+  }
+}
+
+func TestFollowerSyncsAndIsPromoted(t *testing.T) {
+
+  leader := newReplicatingStorage(newMapCacheStorage(newMemoryLimit(0), nil), "secret")
+  leader.Set("before", 0, 0, 3, []byte("old"))
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go leader.serve(listener)
+
+  replica := newMapCacheStorage(newMemoryLimit(0), nil)
+  replica.Set("stale", 0, 0, 3, []byte("old"))
+  defer func(previous *Follower) { follower = previous }(follower)
+  follower = newFollower(listener.Addr().String(), replica, "secret")
+  go follower.run()
+
+  assertEquals(t, eventually(holds(replica, "before", "old")), true, "full sync not applied")
+  assertEquals(t, holds(replica, "stale", "old")(), false, "full sync kept a stale item")
+
+  leader.Set("after", 0, 0, 3, []byte("new"))
+  leader.Append("after", 1, []byte("!"))
+  leader.Delete("before")
+  assertEquals(t, eventually(holds(replica, "after", "new!")), true, "updates not applied")
+  assertEquals(t, holds(replica, "before", "old")(), false, "delete not applied")
+
+  conn := &recordingConn{input: bytes.NewBufferString("delete after\r\n")}
+  session, _ := NewSession(conn, replica)
+  session.serve()
+  assertEquals(t, conn.output.String(), "SERVER_ERROR read only replica\r\n", "replica took a write")
+
+  assertEquals(t, follower.Promote(), true, "not promoted")
+  assertEquals(t, follower.Promote(), false, "promoted twice")
+  conn = &recordingConn{input: bytes.NewBufferString("delete after\r\n")}
+  session, _ = NewSession(conn, replica)
+  session.serve()
+  assertEquals(t, conn.output.String(), "DELETED\r\n", "promoted replica refused a write")
+
+  leader.Set("late", 0, 0, 3, []byte("new"))
+  time.Sleep(2e8)
+  assertEquals(t, holds(replica, "late", "new")(), false, "promoted replica still follows")
+}
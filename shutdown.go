@@ -0,0 +1,163 @@
+package main
+
+import (
+  "io"
+  "net"
+  "sync"
+  "time"
+  "sync/atomic"
+)
+
+/* session states. A session is busy from the moment it has read a command
+   until its reply is written, idle sessions can be closed at any time */
+const (
+  sessionIdle = iota
+  sessionBusy
+  sessionClosed
+)
+
+/* Keeps track of the listeners and client sessions so the server can stop
+   accepting and let sessions finish the command they are running */
+type ConnectionTracker struct {
+  lock      sync.Mutex
+  sessions  map[*Session]bool
+  listeners []io.Closer // listeners and udp sockets
+  draining  int32
+  stopped   chan bool // closed once the server stops accepting
+}
+
+var connections = newConnectionTracker()
+
+func newConnectionTracker() *ConnectionTracker {
+  return &ConnectionTracker{sessions: make(map[*Session]bool), stopped: make(chan bool)}
+}
+
+/* whether clients may shut the server down with the shutdown command */
+var shutdownEnabled bool
+
+/* functions run once connections are drained, in registration order */
+var shutdownHooks []func()
+
+func onShutdown(hook func()) {
+  shutdownHooks = append(shutdownHooks, hook)
+}
+
+func (self *ConnectionTracker) listen(listener io.Closer) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.listeners = append(self.listeners, listener)
+}
+
+/* register a session, false if the server is shutting down */
+func (self *ConnectionTracker) add(s *Session) bool {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if self.isDraining() {
+    return false
+  }
+  self.sessions[s] = true
+  return true
+}
+
+func (self *ConnectionTracker) remove(s *Session) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.sessions[s] = false, false
+}
+
+func (self *ConnectionTracker) isDraining() bool {
+  return atomic.LoadInt32(&self.draining) == 1
+}
+
+/* stop accepting connections, making the accept loops return */
+func (self *ConnectionTracker) stopAccepting() {
+  if !atomic.CompareAndSwapInt32(&self.draining, 0, 1) {
+    return
+  }
+  logger.Println("Shutting down, no longer accepting connections")
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  for _, listener := range self.listeners {
+    // closing a unix listener removes its socket file, which the upgraded
+    // process is serving on. It is left open until this process exits
+    inner := listener
+    if secure, ok := listener.(*tlsListener); ok {
+      inner = secure.Listener
+    }
+    if _, unix := inner.(*net.UnixListener); unix && handedOff {
+      continue
+    }
+    listener.Close()
+  }
+  close(self.stopped)
+}
+
+/* block until the server stops accepting */
+func (self *ConnectionTracker) wait() {
+  <-self.stopped
+}
+
+/* close idle sessions and wait up to timeout nanoseconds for the busy ones
+   to finish their command, closing whatever remains afterwards */
+func (self *ConnectionTracker) drain(timeout int64) {
+  self.stopAccepting()
+  deadline := time.Nanoseconds() + timeout
+  for {
+    self.lock.Lock()
+    remaining := len(self.sessions)
+    for s, _ := range self.sessions {
+      if time.Nanoseconds() >= deadline {
+        s.conn.Close()
+      } else {
+        s.closeIfIdle()
+      }
+    }
+    self.lock.Unlock()
+    if remaining == 0 || time.Nanoseconds() >= deadline {
+      if remaining > 0 {
+        logger.Printf("Closed %d sessions still busy after the shutdown timeout", remaining)
+      }
+      return
+    }
+    time.Sleep(1e7)
+  }
+}
+
+/* drain the connections and run the shutdown hooks */
+func gracefulShutdown(timeout int64) {
+  connections.drain(timeout)
+  if handedOff {
+    logger.Println("Skipping shutdown hooks, the upgraded process has taken over")
+    return
+  }
+  for _, hook := range shutdownHooks {
+    hook()
+  }
+  logger.Println("Shutdown complete")
+}
+
+/* mark the session busy with a command, false if it has been closed */
+func (s *Session) begin() bool {
+  return atomic.CompareAndSwapInt32(&s.state, sessionIdle, sessionBusy)
+}
+
+/* mark the command done, false if the session must stop as the server is
+   shutting down. Replies are sent by the next read, or right away when
+   shutting down */
+func (s *Session) end() bool {
+  if connections.isDraining() {
+    s.flush()
+  }
+  atomic.StoreInt32(&s.state, sessionIdle)
+  return !connections.isDraining() || !s.closeIfIdle()
+}
+
+func (s *Session) closeIfIdle() bool {
+  if atomic.CompareAndSwapInt32(&s.state, sessionIdle, sessionClosed) {
+    if s.conn != nil {
+      s.conn.Close()
+    }
+    return true
+  }
+  return false
+}
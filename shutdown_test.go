@@ -0,0 +1,129 @@
+package main
+
+import (
+  "io"
+  "net"
+  "time"
+  "bytes"
+  "testing"
+  "sync/atomic"
+)
+
+/* run a session on a pipe as clientHandler does, with a tracker of its own
+   in place of connections. done is closed once the session is gone */
+func trackedSession(t *testing.T, storage CacheStorage) (session *Session, client net.Conn, done chan bool) {
+  server, client := net.Pipe()
+  session, _ = NewSession(server, storage)
+  if !connections.add(session) {
+    t.Fatal("session refused")
+  }
+  done = make(chan bool)
+  go func() {
+    defer close(done)
+    defer connections.remove(session)
+    session.serve()
+  }()
+  return session, client, done
+}
+
+/* replace connections for the duration of a test */
+func freshConnections() func() {
+  previous := connections
+  connections = newConnectionTracker()
+  return func() { connections = previous }
+}
+
+func TestDrainClosesIdleSessions(t *testing.T) {
+
+  defer freshConnections()()
+  _, client, done := trackedSession(t, newMapCacheStorage(newMemoryLimit(0), nil))
+
+  start := time.Nanoseconds()
+  connections.drain(5e9)
+  <-done
+  assertEquals(t, time.Nanoseconds() - start < 1e9, true, "idle session waited for")
+  _, err := client.Read(make([]byte, 1))
+  assertEquals(t, err != nil, true, "idle session left open")
+  assertEquals(t, connections.add(&Session{}), false, "session accepted while draining")
+}
+
+func TestDrainLetsBusySessionsFinish(t *testing.T) {
+
+  defer freshConnections()()
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  session, client, done := trackedSession(t, storage)
+
+  // the session is busy until it has read the data block
+  io.WriteString(client, "set foo 0 0 3\r\n")
+  eventually(func() bool { return atomic.LoadInt32(&session.state) == sessionBusy })
+  drained := make(chan bool)
+  go func() {
+    connections.drain(5e9)
+    close(drained)
+  }()
+  time.Sleep(1e8)
+  assertEquals(t, connections.isDraining(), true, "not draining")
+
+  io.WriteString(client, "bar\r\n")
+  reply := make([]byte, len("STORED\r\n"))
+  _, err := io.ReadFull(client, reply)
+  assertEquals(t, err == nil && string(reply) == "STORED\r\n", true, "busy command not finished")
+  <-done
+  <-drained
+  assertEquals(t, holds(storage, "foo", "bar")(), true, "busy command not applied")
+  _, err = client.Read(make([]byte, 1))
+  assertEquals(t, err != nil, true, "session left open after its command")
+}
+
+func TestDrainClosesBusySessionsAtTheDeadline(t *testing.T) {
+
+  defer freshConnections()()
+  session, client, done := trackedSession(t, newMapCacheStorage(newMemoryLimit(0), nil))
+
+  io.WriteString(client, "set foo 0 0 3\r\n")
+  eventually(func() bool { return atomic.LoadInt32(&session.state) == sessionBusy })
+  start := time.Nanoseconds()
+  connections.drain(2e8)
+  elapsed := time.Nanoseconds() - start
+  <-done
+  assertEquals(t, elapsed >= 2e8 && elapsed < 2e9, true, "deadline not kept")
+}
+
+func TestShutdownHooksRunInOrder(t *testing.T) {
+
+  defer freshConnections()()
+  defer func(hooks []func()) { shutdownHooks = hooks }(shutdownHooks)
+  shutdownHooks = nil
+  var ran []int
+  onShutdown(func() { ran = append(ran, 1) })
+  onShutdown(func() { ran = append(ran, 2) })
+
+  gracefulShutdown(1e9)
+  assertEquals(t, len(ran), 2, "hooks not run")
+  assertEquals(t, len(ran) == 2 && ran[0] == 1 && ran[1] == 2, true, "hooks not run in order")
+
+  connections = newConnectionTracker()
+  handedOff, ran = true, nil
+  defer func() { handedOff = false }()
+  gracefulShutdown(1e9)
+  assertEquals(t, len(ran), 0, "hooks run after a handoff")
+}
+
+func TestShutdownCommandNeedsEnabling(t *testing.T) {
+
+  defer freshConnections()()
+  defer func() { shutdownEnabled = false }()
+
+  conn := &recordingConn{input: bytes.NewBufferString("shutdown\r\n")}
+  session, _ := NewSession(conn, nil)
+  session.serve()
+  assertEquals(t, conn.output.String(), "ERROR: shutdown not enabled\r\n", "shutdown not refused")
+  assertEquals(t, connections.isDraining(), false, "shutdown while disabled")
+
+  shutdownEnabled = true
+  conn = &recordingConn{input: bytes.NewBufferString("shutdown\r\nget foo\r\n")}
+  session, _ = NewSession(conn, newMapCacheStorage(newMemoryLimit(0), nil))
+  session.serve()
+  assertEquals(t, conn.output.String(), "OK\r\n", "shutdown not run or session not closed")
+  assertEquals(t, connections.isDraining(), true, "shutdown didn't stop accepting")
+}
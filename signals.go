@@ -0,0 +1,25 @@
+package main
+
+import (
+  "os"
+  "os/signal"
+)
+
+/* os/signal delivers every signal through a single channel, handlers are
+   registered here and run from one dispatching goroutine. The map isn't
+   locked, every handler must be registered before dispatchSignals starts */
+var signalHandlers = make(map[os.UnixSignal][]func())
+
+func onSignal(sig os.UnixSignal, handler func()) {
+  signalHandlers[sig] = append(signalHandlers[sig], handler)
+}
+
+func dispatchSignals() {
+  for sig := range signal.Incoming {
+    if unixSignal, ok := sig.(os.UnixSignal); ok {
+      for _, handler := range signalHandlers[unixSignal] {
+        handler()
+      }
+    }
+  }
+}
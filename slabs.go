@@ -0,0 +1,327 @@
+package main
+
+import (
+  "sync"
+  "sync/atomic"
+  "time"
+  "strconv"
+)
+
+/* Item payloads live in chunks carved out of large pages, grouped in classes
+   of growing chunk sizes like memcached does. Chunks are recycled instead of
+   being left to the garbage collector. No more pages are carved than the
+   memory limit holds, a class short of chunks then evicts its own items and
+   the rebalancer frees a page of another class for it */
+
+const (
+  slabPageSize   = 1024 * 1024
+  slabChunkAlign = 8
+)
+
+/* the server allocator, nil until main sets it up */
+var slabAllocator *SlabAllocator
+
+type SlabAllocator struct {
+  lock       sync.Mutex
+  classes    []*SlabClass
+  // pages given back by rebalancing, ready to be carved for any class
+  freePages  [][]byte
+  totalPages int
+  maxPages   int // 0 for unlimited
+}
+
+type SlabClass struct {
+  allocator *SlabAllocator
+  id        int
+  chunkSize int
+  pages     []*slabPage
+  free      []*SlabChunk
+  used      uint64
+  evicted   uint64
+  starved   bool // ran out of chunks with no page left to carve
+}
+
+type slabPage struct {
+  class  *SlabClass
+  memory []byte
+  used   int
+  chunks []*SlabChunk
+}
+
+/* a chunk holding one item payload. Entries sharing a payload share the
+   chunk, which goes back to its class once every reference is released */
+type SlabChunk struct {
+  memory []byte
+  page   *slabPage
+  refs   int32
+  // the storage and key of the entry linked with the chunk, to evict it
+  // when its page is taken away
+  owner  chunkOwner
+  key    string
+}
+
+type chunkOwner interface {
+  evictChunk(key string, chunk *SlabChunk)
+}
+
+/* build the classes from minChunk up to half a page, each factor times
+   larger than the previous one. The last class takes a whole page. At most
+   limit bytes of pages are carved, 0 for unlimited */
+func newSlabAllocator(minChunk int, factor float64, limit int64) *SlabAllocator {
+  allocator := &SlabAllocator{maxPages: int(limit / slabPageSize)}
+  if limit > 0 && allocator.maxPages == 0 {
+    allocator.maxPages = 1
+  }
+  for size := minChunk; size <= slabPageSize / 2; {
+    allocator.addClass(size)
+    next := int(float64(size) * factor)
+    if next % slabChunkAlign != 0 {
+      next += slabChunkAlign - next % slabChunkAlign
+    }
+    if next <= size {
+      next = size + slabChunkAlign
+    }
+    size = next
+  }
+  allocator.addClass(slabPageSize)
+  return allocator
+}
+
+func (self *SlabAllocator) addClass(chunkSize int) {
+  class := &SlabClass{allocator: self, id: len(self.classes) + 1, chunkSize: chunkSize}
+  self.classes = append(self.classes, class)
+}
+
+func (self *SlabAllocator) classFor(size int) *SlabClass {
+  for _, class := range self.classes {
+    if class.chunkSize >= size {
+      return class
+    }
+  }
+  return nil
+}
+
+/* get a chunk for size bytes, with a reference held by the caller. Without
+   an allocator, or for items larger than a page, the chunk is a plain
+   heap allocation. Nil when the class is out of chunks and no page may be
+   carved for it */
+func (self *SlabAllocator) Alloc(size int) *SlabChunk {
+  var class *SlabClass
+  if self != nil {
+    class = self.classFor(size)
+  }
+  if class == nil {
+    return &SlabChunk{memory: make([]byte, size), refs: 1}
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if len(class.free) == 0 && !self.grow(class) {
+    class.starved = true
+    return nil
+  }
+  chunk := class.free[len(class.free)-1]
+  class.free = class.free[:len(class.free)-1]
+  chunk.refs = 1
+  chunk.page.used++
+  class.used++
+  return chunk
+}
+
+/* carve a new page into chunks for class, false once the limit is reached.
+   Must hold the lock */
+func (self *SlabAllocator) grow(class *SlabClass) bool {
+  var memory []byte
+  if n := len(self.freePages); n > 0 {
+    memory = self.freePages[n-1]
+    self.freePages = self.freePages[:n-1]
+  } else if self.maxPages > 0 && self.totalPages >= self.maxPages {
+    return false
+  } else {
+    memory = make([]byte, slabPageSize)
+    self.totalPages++
+  }
+  page := &slabPage{class: class, memory: memory}
+  for offset := 0; offset + class.chunkSize <= len(memory); offset += class.chunkSize {
+    chunk := &SlabChunk{memory: memory[offset:offset+class.chunkSize], page: page}
+    page.chunks = append(page.chunks, chunk)
+    class.free = append(class.free, chunk)
+  }
+  class.pages = append(class.pages, page)
+  return true
+}
+
+func (self *SlabAllocator) free(chunk *SlabChunk) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  class := chunk.page.class
+  class.free = append(class.free, chunk)
+  chunk.page.used--
+  chunk.owner, chunk.key = nil, ""
+  class.used--
+}
+
+/* record the entry linked with chunk */
+func (self *SlabAllocator) own(chunk *SlabChunk, owner chunkOwner, key string) {
+  if self == nil || chunk == nil || chunk.page == nil {
+    return
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  chunk.owner, chunk.key = owner, key
+}
+
+func (self *SlabChunk) acquire() {
+  atomic.AddInt32(&self.refs, 1)
+}
+
+func (self *SlabChunk) release() {
+  if atomic.AddInt32(&self.refs, -1) == 0 && self.page != nil {
+    self.page.class.allocator.free(self)
+  }
+}
+
+func (self *SlabAllocator) noteEvicted(chunk *SlabChunk) {
+  if self == nil || chunk == nil || chunk.page == nil {
+    return
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  chunk.page.class.evicted++
+}
+
+/* take the unused pages away from their classes so classes short of chunks
+   can carve them again when the workload shifts. When a class starved and
+   no page is left the items of a page of the class with the most pages are
+   evicted, the page is taken once their readers are done with them */
+func (self *SlabAllocator) Rebalance() {
+  self.lock.Lock()
+  self.reclaimPages()
+  victims := self.donorChunks()
+  self.lock.Unlock()
+  if len(victims) == 0 {
+    return
+  }
+  // outside the lock, the owners free the chunks through it
+  for _, victim := range victims {
+    victim.owner.evictChunk(victim.key, victim.chunk)
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.reclaimPages()
+}
+
+type slabVictim struct {
+  chunk *SlabChunk
+  owner chunkOwner
+  key   string
+}
+
+/* the chunks in use on the page given up for a starved class. Must hold
+   the lock */
+func (self *SlabAllocator) donorChunks() []slabVictim {
+  starved := false
+  for _, class := range self.classes {
+    starved = starved || class.starved
+  }
+  if !starved || len(self.freePages) > 0 {
+    return nil
+  }
+  var donor *SlabClass
+  for _, class := range self.classes {
+    if !class.starved && len(class.pages) > 1 && (donor == nil || len(class.pages) > len(donor.pages)) {
+      donor = class
+    }
+  }
+  for _, class := range self.classes {
+    class.starved = false
+  }
+  if donor == nil {
+    return nil
+  }
+  page := donor.pages[0]
+  for _, candidate := range donor.pages {
+    if candidate.used < page.used {
+      page = candidate
+    }
+  }
+  var victims []slabVictim
+  for _, chunk := range page.chunks {
+    if chunk.owner != nil {
+      victims = append(victims, slabVictim{chunk, chunk.owner, chunk.key})
+    }
+  }
+  return victims
+}
+
+/* move the pages nothing uses to the free pages, every class keeps one.
+   Must hold the lock */
+func (self *SlabAllocator) reclaimPages() {
+  for _, class := range self.classes {
+    for i := 0; i < len(class.pages) && len(class.pages) > 1; {
+      page := class.pages[i]
+      if page.used > 0 {
+        i++
+        continue
+      }
+      class.pages = append(class.pages[:i], class.pages[i+1:]...)
+      free := class.free[:0]
+      for _, chunk := range class.free {
+        if chunk.page != page {
+          free = append(free, chunk)
+        }
+      }
+      class.free = free
+      self.freePages = append(self.freePages, page.memory)
+    }
+  }
+}
+
+func (self *SlabAllocator) rebalancer(interval int64) {
+  for {
+    time.Sleep(interval * 1e9)
+    self.Rebalance()
+  }
+}
+
+/* per class statistics for stats slabs */
+func (self *SlabAllocator) slabStats() []Stat {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  var stats []Stat
+  active := 0
+  for _, class := range self.classes {
+    if len(class.pages) == 0 {
+      continue
+    }
+    active++
+    prefix := strconv.Itoa(class.id) + ":"
+    stats = append(stats,
+      Stat{prefix + "chunk_size", strconv.Itoa(class.chunkSize)},
+      Stat{prefix + "chunks_per_page", strconv.Itoa(slabPageSize / class.chunkSize)},
+      Stat{prefix + "total_pages", strconv.Itoa(len(class.pages))},
+      Stat{prefix + "total_chunks", strconv.Itoa(len(class.pages) * (slabPageSize / class.chunkSize))},
+      Stat{prefix + "used_chunks", strconv.Uitoa64(class.used)},
+      Stat{prefix + "free_chunks", strconv.Itoa(len(class.free))})
+  }
+  return append(stats,
+    Stat{"active_slabs", strconv.Itoa(active)},
+    Stat{"total_malloced", strconv.Itoa64(int64(self.totalPages) * slabPageSize)},
+    Stat{"free_pages", strconv.Itoa(len(self.freePages))})
+}
+
+/* per class item statistics for stats items */
+func (self *SlabAllocator) itemStats() []Stat {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  var stats []Stat
+  for _, class := range self.classes {
+    if len(class.pages) == 0 {
+      continue
+    }
+    prefix := "items:" + strconv.Itoa(class.id) + ":"
+    stats = append(stats,
+      Stat{prefix + "number", strconv.Uitoa64(class.used)},
+      Stat{prefix + "evicted", strconv.Uitoa64(class.evicted)})
+  }
+  return stats
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestSlabClassesGrowByFactor(t *testing.T) {
+
+  allocator := newSlabAllocator(48, 2, 0)
+
+  assertEquals(t, allocator.classes[0].chunkSize, 48, "invalid first class")
+  assertEquals(t, allocator.classes[1].chunkSize, 96, "invalid second class")
+  assertEquals(t, allocator.classes[len(allocator.classes)-1].chunkSize, slabPageSize, "invalid last class")
+}
+
+func TestSlabChunksAreRecycled(t *testing.T) {
+
+  allocator := newSlabAllocator(48, 2, 0)
+
+  chunk := allocator.Alloc(40)
+  assertEquals(t, len(chunk.memory), 48, "invalid chunk size")
+  chunk.acquire()
+  chunk.release()
+  assertEquals(t, allocator.classes[0].used, uint64(1), "chunk freed while referenced")
+  chunk.release()
+  assertEquals(t, allocator.classes[0].used, uint64(0), "chunk not freed")
+  assertEquals(t, allocator.Alloc(10), chunk, "chunk not reused")
+}
+
+func TestSlabRebalanceMovesPages(t *testing.T) {
+
+  allocator := newSlabAllocator(48, 2, 0)
+
+  var chunks []*SlabChunk
+  for i := 0; i < 2 * slabPageSize / 48; i++ {
+    chunks = append(chunks, allocator.Alloc(48))
+  }
+  for _, chunk := range chunks {
+    chunk.release()
+  }
+  allocator.Rebalance()
+  assertEquals(t, len(allocator.classes[0].pages), 1, "unused page not taken back")
+  assertEquals(t, len(allocator.freePages), 1, "page not available to other classes")
+
+  allocator.Alloc(100)
+  assertEquals(t, len(allocator.freePages), 0, "free page not reused")
+}
+
+func TestHugeItemsAreLeftToTheHeap(t *testing.T) {
+
+  allocator := newSlabAllocator(48, 2, 0)
+
+  chunk := allocator.Alloc(slabPageSize + 1)
+  assertEquals(t, chunk.page, (*slabPage)(nil), "huge item in a slab")
+  chunk.release()
+}
+
+type recordingOwner struct {
+  evicted []string
+}
+
+func (self *recordingOwner) evictChunk(key string, chunk *SlabChunk) {
+  self.evicted = append(self.evicted, key)
+  chunk.release()
+}
+
+func TestSlabPagesAreCappedAndTakenFromDonors(t *testing.T) {
+
+  allocator := newSlabAllocator(48, 2, 2 * slabPageSize)
+
+  owner := &recordingOwner{}
+  for i := 0; i < 2 * slabPageSize / 48; i++ {
+    allocator.own(allocator.Alloc(48), owner, "small")
+  }
+  assertEquals(t, allocator.Alloc(100), (*SlabChunk)(nil), "page carved past the limit")
+  assertEquals(t, allocator.totalPages, 2, "invalid number of pages")
+
+  allocator.Rebalance()
+  assertEquals(t, len(owner.evicted), slabPageSize / 48, "donor page not evicted")
+  assertEquals(t, len(allocator.classes[0].pages), 1, "donor page not taken")
+  assertEquals(t, allocator.Alloc(100) != nil, true, "starved class not given a page")
+}
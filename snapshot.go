@@ -0,0 +1,258 @@
+package main
+
+import (
+  "os"
+  "io"
+  "io/ioutil"
+  "bufio"
+  "bytes"
+  "sync"
+  "time"
+  "hash/crc32"
+  "encoding/binary"
+  "sync/atomic"
+)
+
+/* Snapshot file layout, integers in big endian:
+
+   "GOCACHED" version:uint32 generation:uint64
+   { 1 keylen:uint16 key flags:uint32 exptime:uint32 cas:uint64 bytes:uint32 content }*
+   0 crc32:uint32
+
+   The checksum covers everything before it. The generation is the one of
+   the journal started right before the snapshot, journals of earlier
+   generations are covered by it. Version 1 snapshots have no generation */
+
+const (
+  snapshotMagic   = "GOCACHED"
+  snapshotVersion = 2
+  entryHeaderLength = 22
+)
+
+type Snapshotter struct {
+  path       string
+  storage    CacheStorage
+  lock       sync.Mutex
+  paused     bool   // while an upgraded process takes the file over
+  generation uint64 // of the snapshot on disk
+}
+
+func newSnapshotter(path string, storage CacheStorage) *Snapshotter {
+  self := &Snapshotter{path: path, storage: storage}
+  // known before loading, the contents may come from somewhere else
+  if file, err := os.Open(path); err == nil {
+    header := make([]byte, len(snapshotMagic) + 12)
+    if n, _ := io.ReadFull(file, header); n > 0 {
+      self.generation, _, _ = parseSnapshotHeader(header[:n])
+    }
+    file.Close()
+  }
+  return self
+}
+
+/* encode an entry as: keylen:uint16 key flags:uint32 exptime:uint32
+   cas:uint64 bytes:uint32 content */
+func writeEntry(w io.Writer, key string, entry *StorageEntry) os.Error {
+  header := make([]byte, entryHeaderLength)
+  binary.BigEndian.PutUint16(header[0:2], uint16(len(key)))
+  binary.BigEndian.PutUint32(header[2:6], entry.flags)
+  binary.BigEndian.PutUint32(header[6:10], entry.exptime)
+  binary.BigEndian.PutUint64(header[10:18], entry.cas_unique)
+  binary.BigEndian.PutUint32(header[18:22], uint32(len(entry.content)))
+  if _, err := w.Write(header[0:2]); err != nil {
+    return err
+  } else if _, err := io.WriteString(w, key); err != nil {
+    return err
+  } else if _, err := w.Write(header[2:]); err != nil {
+    return err
+  }
+  _, err := w.Write(entry.content)
+  return err
+}
+
+func readEntry(r io.Reader) (string, *StorageEntry, os.Error) {
+  header := make([]byte, entryHeaderLength)
+  if _, err := io.ReadFull(r, header[0:2]); err != nil {
+    return "", nil, err
+  }
+  key := make([]byte, binary.BigEndian.Uint16(header[0:2]))
+  if _, err := io.ReadFull(r, key); err != nil {
+    return "", nil, err
+  } else if _, err := io.ReadFull(r, header[2:]); err != nil {
+    return "", nil, err
+  }
+  content := make([]byte, binary.BigEndian.Uint32(header[18:22]))
+  if _, err := io.ReadFull(r, content); err != nil {
+    return "", nil, err
+  }
+  entry := newStorageEntry(binary.BigEndian.Uint32(header[6:10]), binary.BigEndian.Uint32(header[2:6]),
+                           uint32(len(content)), binary.BigEndian.Uint64(header[10:18]), content)
+  return string(key), entry, nil
+}
+
+/* write every entry to a temporary file and move it over the snapshot */
+func (self *Snapshotter) Save() os.Error {
+  return self.saveGeneration(self.generation)
+}
+
+/* save a snapshot covering the journals before generation */
+func (self *Snapshotter) saveGeneration(generation uint64) os.Error {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if self.paused {
+    return os.NewError("Snapshots paused for an upgrade")
+  }
+  start := time.Nanoseconds()
+  tmpPath := self.path + ".tmp"
+  file, err := os.Create(tmpPath)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  count, err := writeSnapshot(file, self.storage, generation)
+  if err != nil {
+    return err
+  } else if err = file.Sync(); err != nil {
+    return err
+  } else if err = os.Rename(tmpPath, self.path); err != nil {
+    return err
+  }
+  self.generation = generation
+  logger.Printf("Saved %d items to snapshot %s in %dms", count, self.path, (time.Nanoseconds() - start) / 1e6)
+  return nil
+}
+
+/* write a complete snapshot of storage to w, returns the number of entries */
+func writeSnapshot(w io.Writer, storage CacheStorage, generation uint64) (int, os.Error) {
+  checksum := crc32.NewIEEE()
+  writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+  version := make([]byte, 12)
+  binary.BigEndian.PutUint32(version[0:4], snapshotVersion)
+  binary.BigEndian.PutUint64(version[4:12], generation)
+  writer.WriteString(snapshotMagic)
+  writer.Write(version)
+  count := 0
+  var err os.Error
+  storage.Walk(func(key string, entry *StorageEntry) {
+    if err == nil {
+      writer.WriteByte(1)
+      err = writeEntry(writer, key, entry)
+      count++
+    }
+  })
+  if err != nil {
+    return 0, err
+  }
+  writer.WriteByte(0)
+  if err = writer.Flush(); err != nil {
+    return 0, err
+  }
+  sum := make([]byte, 4)
+  binary.BigEndian.PutUint32(sum, checksum.Sum32())
+  _, err = w.Write(sum)
+  return count, err
+}
+
+/* load the snapshot into the storage, a missing snapshot is not an error */
+func (self *Snapshotter) Load() os.Error {
+  data, err := ioutil.ReadFile(self.path)
+  if err != nil {
+    if pathError, ok := err.(*os.PathError); ok && pathError.Error == os.ENOENT {
+      return nil
+    }
+    return err
+  }
+  count, err := loadSnapshot(data, self.storage)
+  if err == nil {
+    self.generation, _, _ = parseSnapshotHeader(data)
+    logger.Printf("Loaded %d items from snapshot %s", count, self.path)
+  }
+  return err
+}
+
+/* the generation of a snapshot and the length of its header */
+func parseSnapshotHeader(data []byte) (uint64, int, os.Error) {
+  header := len(snapshotMagic) + 4
+  if len(data) < header || string(data[:len(snapshotMagic)]) != snapshotMagic {
+    return 0, 0, os.NewError("Not a snapshot file")
+  }
+  switch binary.BigEndian.Uint32(data[len(snapshotMagic):header]) {
+  case 1:
+    return 0, header, nil
+  case snapshotVersion:
+    if len(data) < header + 8 {
+      return 0, 0, os.NewError("Not a snapshot file")
+    }
+    return binary.BigEndian.Uint64(data[header:header + 8]), header + 8, nil
+  }
+  return 0, 0, os.NewError("Unsupported snapshot version")
+}
+
+/* verify a snapshot and store its entries that haven't expired yet */
+func loadSnapshot(data []byte, storage CacheStorage) (int, os.Error) {
+  _, header, err := parseSnapshotHeader(data)
+  if err != nil {
+    return 0, err
+  } else if len(data) < header + 5 {
+    return 0, os.NewError("Not a snapshot file")
+  } else if crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+    return 0, os.NewError("Corrupted snapshot, bad checksum")
+  }
+  reader := bytes.NewBuffer(data[header:len(data)-4])
+  count := 0
+  for {
+    if marker, err := reader.ReadByte(); err != nil {
+      return count, err
+    } else if marker == 0 {
+      return count, nil
+    }
+    key, entry, err := readEntry(reader)
+    if err != nil {
+      return count, err
+    }
+    restoreEntry(storage, key, entry)
+    count++
+  }
+  return count, nil
+}
+
+/* store an entry read back from disk. Entries get new cas values, but the
+   sequence is moved past the saved ones so none is ever handed out twice */
+func restoreEntry(storage CacheStorage, key string, entry *StorageEntry) {
+  if entry.expired() {
+    return
+  }
+  for current := atomic.LoadUint64(&casCounter); current < entry.cas_unique; current = atomic.LoadUint64(&casCounter) {
+    if atomic.CompareAndSwapUint64(&casCounter, current, entry.cas_unique) {
+      break
+    }
+  }
+  storage.Set(key, entry.flags, entry.exptime, entry.bytes, entry.content)
+}
+
+/* stop saving snapshots, waiting for one being saved */
+func (self *Snapshotter) Pause() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.paused = true
+}
+
+func (self *Snapshotter) Resume() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.paused = false
+}
+
+func (self *Snapshotter) saveOrLog() {
+  if err := self.Save(); err != nil {
+    logger.Printf("Unable to save snapshot %s: %s", self.path, err)
+  }
+}
+
+/* run f every interval seconds */
+func periodically(interval int64, f func()) {
+  for {
+    time.Sleep(interval * 1e9)
+    f()
+  }
+}
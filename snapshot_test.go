@@ -0,0 +1,44 @@
+package main
+
+import (
+  "bytes"
+  "testing"
+  "time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+
+  source := newMapCacheStorage(newMemoryLimit(0), nil)
+  source.Set("foo", 12, 0, 3, []byte("bar"))
+  source.Set("expired", 0, uint32(time.Seconds()) - 10, 3, []byte("old"))
+
+  var buffer bytes.Buffer
+  count, err := writeSnapshot(&buffer, source, 0)
+  assertEquals(t, err == nil, true, "snapshot not written")
+  assertEquals(t, count, 1, "expired entry saved")
+
+  target := newMapCacheStorage(newMemoryLimit(0), nil)
+  count, err = loadSnapshot(buffer.Bytes(), target)
+  assertEquals(t, err == nil, true, "snapshot not loaded")
+  assertEquals(t, count, 1, "wrong number of entries loaded")
+
+  code, entry := target.Get("foo")
+  assertEquals(t, code, ErrorCode(Ok), "entry not restored")
+  assertEquals(t, entry.flags, uint32(12), "flags not restored")
+  assertEquals(t, string(entry.content), "bar", "content not restored")
+  entry.release()
+}
+
+func TestSnapshotChecksumMismatch(t *testing.T) {
+
+  source := newMapCacheStorage(newMemoryLimit(0), nil)
+  source.Set("foo", 0, 0, 3, []byte("bar"))
+
+  var buffer bytes.Buffer
+  writeSnapshot(&buffer, source, 0)
+  data := buffer.Bytes()
+  data[len(data) - 6] ^= 0xff
+
+  _, err := loadSnapshot(data, newMapCacheStorage(newMemoryLimit(0), nil))
+  assertEquals(t, err != nil, true, "corrupted snapshot loaded")
+}
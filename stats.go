@@ -0,0 +1,124 @@
+package main
+
+import (
+  "os"
+  "time"
+  "sync/atomic"
+  "strconv"
+)
+
+const Version = "0.1"
+
+/* server-wide counters, shared by every session and storage partition.
+   all fields are updated atomically */
+type ServerStats struct {
+  startTime         int64
+  currConnections   int64
+  totalConnections  uint64
+  cmdGet            uint64
+  cmdSet            uint64
+  cmdFlush          uint64
+  cmdTouch          uint64
+  touchHits         uint64
+  touchMisses       uint64
+  getHits           uint64
+  getMisses         uint64
+  deleteHits        uint64
+  deleteMisses      uint64
+  incrHits          uint64
+  incrMisses        uint64
+  decrHits          uint64
+  decrMisses        uint64
+  casHits           uint64
+  casMisses         uint64
+  casBadval         uint64
+  bytes             int64
+  currItems         int64
+  totalItems        uint64
+  evictions         uint64
+  limitMaxbytes     int64
+  expiredUnfetched  uint64
+}
+
+/* a single name/value pair as reported by the stats command */
+type Stat struct {
+  name  string
+  value string
+}
+
+var serverStats = &ServerStats{startTime: time.Seconds()}
+
+func (self *ServerStats) connectionOpened() {
+  atomic.AddInt64(&self.currConnections, 1)
+  atomic.AddUint64(&self.totalConnections, 1)
+}
+
+func (self *ServerStats) connectionClosed() {
+  atomic.AddInt64(&self.currConnections, -1)
+}
+
+/* account for an entry that has been linked into a storage */
+func (self *ServerStats) itemLinked(entry *StorageEntry) {
+  atomic.AddInt64(&self.currItems, 1)
+  atomic.AddInt64(&self.bytes, int64(entry.bytes))
+  atomic.AddUint64(&self.totalItems, 1)
+}
+
+/* account for an entry that has been removed or replaced in a storage */
+func (self *ServerStats) itemUnlinked(entry *StorageEntry) {
+  atomic.AddInt64(&self.currItems, -1)
+  atomic.AddInt64(&self.bytes, -int64(entry.bytes))
+  if entry.expired() && !entry.fetched {
+    atomic.AddUint64(&self.expiredUnfetched, 1)
+  }
+}
+
+func (self *ServerStats) evict() {
+  atomic.AddUint64(&self.evictions, 1)
+}
+
+func (self *ServerStats) hit(hits *uint64, misses *uint64, hit bool) {
+  if hit {
+    atomic.AddUint64(hits, 1)
+  } else {
+    atomic.AddUint64(misses, 1)
+  }
+}
+
+/* the general purpose statistics, in the order memcached reports them */
+func (self *ServerStats) general() []Stat {
+  now := time.Seconds()
+  u := func(counter *uint64) string { return strconv.Uitoa64(atomic.LoadUint64(counter)) }
+  i := func(counter *int64) string { return strconv.Itoa64(atomic.LoadInt64(counter)) }
+  return []Stat{
+    {"pid", strconv.Itoa(os.Getpid())},
+    {"uptime", strconv.Itoa64(now - self.startTime)},
+    {"time", strconv.Itoa64(now)},
+    {"version", Version},
+    {"curr_connections", i(&self.currConnections)},
+    {"total_connections", u(&self.totalConnections)},
+    {"cmd_get", u(&self.cmdGet)},
+    {"cmd_set", u(&self.cmdSet)},
+    {"cmd_flush", u(&self.cmdFlush)},
+    {"cmd_touch", u(&self.cmdTouch)},
+    {"get_hits", u(&self.getHits)},
+    {"get_misses", u(&self.getMisses)},
+    {"touch_hits", u(&self.touchHits)},
+    {"touch_misses", u(&self.touchMisses)},
+    {"delete_misses", u(&self.deleteMisses)},
+    {"delete_hits", u(&self.deleteHits)},
+    {"incr_misses", u(&self.incrMisses)},
+    {"incr_hits", u(&self.incrHits)},
+    {"decr_misses", u(&self.decrMisses)},
+    {"decr_hits", u(&self.decrHits)},
+    {"cas_misses", u(&self.casMisses)},
+    {"cas_hits", u(&self.casHits)},
+    {"cas_badval", u(&self.casBadval)},
+    {"limit_maxbytes", i(&self.limitMaxbytes)},
+    {"bytes", i(&self.bytes)},
+    {"curr_items", i(&self.currItems)},
+    {"total_items", u(&self.totalItems)},
+    {"expired_unfetched", u(&self.expiredUnfetched)},
+    {"evictions", u(&self.evictions)},
+  }
+}
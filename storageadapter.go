@@ -0,0 +1,215 @@
+package main
+
+import (
+  "sync"
+  "time"
+)
+
+/* Exposes a legacy Storage as a CacheStorage so MapStorage and NotifyStorage
+   can be plugged into the server. Storage has no notion of entries, so the
+   adapter fetches them around every operation. The whole sequence runs under
+   a lock to keep it atomic. Cas values are the adapter's own, taken from the
+   server sequence on every mutation, the ones legacy storages keep are per
+   key counters */
+type StorageAdapter struct {
+  storage Storage
+  lock    sync.Mutex
+  cas     map[string]uint64
+}
+
+/* optional operations a Storage may support */
+type flushableStorage interface {
+  Flush()
+}
+
+type walkableStorage interface {
+  Walk(f func(key string, entry *StorageEntry))
+}
+
+type expirableStorage interface {
+  MaybeExpire(key string, now uint32) bool
+}
+
+type expiringStorage interface {
+  Exptime(key string) uint32
+}
+
+func newStorageAdapter(storage Storage) *StorageAdapter {
+  return &StorageAdapter{storage: storage, cas: make(map[string]uint64)}
+}
+
+/* fetch the current entry for key, nil if missing. Must hold the lock */
+func (self *StorageAdapter) current(key string) *StorageEntry {
+  flags, bytes, _, content, err := self.storage.Get(key)
+  if err != nil {
+    self.cas[key] = 0, false
+    return nil
+  }
+  return newStorageEntry(self.exptime(key), flags, bytes, self.cas[key], content)
+}
+
+/* the entry just stored under key, with a new cas value. Must hold the lock */
+func (self *StorageAdapter) stored(key string) *StorageEntry {
+  self.cas[key] = nextCas()
+  return self.current(key)
+}
+
+/* the expiration time of key, 0 when the storage doesn't report it.
+   Must hold the lock */
+func (self *StorageAdapter) exptime(key string) uint32 {
+  if storage, ok := self.storage.(expiringStorage); ok {
+    return storage.Exptime(key)
+  }
+  return 0
+}
+
+/* legacy storages keep the content they are given, copy it out of the
+   session buffers */
+func copyContent(content []byte) []byte {
+  stored := make([]byte, len(content))
+  copy(stored, content)
+  return stored
+}
+
+func (self *StorageAdapter) Set(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (*StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  self.storage.Set(key, flags, exptime, bytes, copyContent(content))
+  return previous, self.stored(key)
+}
+
+func (self *StorageAdapter) Add(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if err := self.storage.Add(key, flags, exptime, bytes, copyContent(content)); err != nil {
+    return KeyAlreadyInUse, nil
+  }
+  return Ok, self.stored(key)
+}
+
+func (self *StorageAdapter) Replace(key string, flags uint32, exptime uint32, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  if previous == nil {
+    return KeyNotFound, nil, nil
+  }
+  if err := self.storage.Replace(key, flags, exptime, bytes, copyContent(content)); err != nil {
+    return KeyNotFound, nil, nil
+  }
+  return Ok, previous, self.stored(key)
+}
+
+func (self *StorageAdapter) Append(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  if previous == nil || self.storage.Append(key, bytes, copyContent(content)) != nil {
+    return KeyNotFound, nil, nil
+  }
+  return Ok, previous, self.stored(key)
+}
+
+func (self *StorageAdapter) Prepend(key string, bytes uint32, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  if previous == nil || self.storage.Prepend(key, bytes, copyContent(content)) != nil {
+    return KeyNotFound, nil, nil
+  }
+  return Ok, previous, self.stored(key)
+}
+
+func (self *StorageAdapter) Cas(key string, flags uint32, exptime uint32, bytes uint32, cas_unique uint64, content []byte) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  if previous == nil {
+    return KeyNotFound, nil, nil
+  }
+  // compared here, the storage only knows its own values
+  if previous.cas_unique != cas_unique {
+    return IllegalParameter, previous, nil
+  }
+  self.storage.Set(key, flags, exptime, bytes, copyContent(content))
+  return Ok, previous, self.stored(key)
+}
+
+func (self *StorageAdapter) Get(key string) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if entry := self.current(key); entry != nil {
+    return Ok, entry
+  }
+  return KeyNotFound, nil
+}
+
+func (self *StorageAdapter) Delete(key string) (ErrorCode, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  exptime, cas_unique := self.exptime(key), self.cas[key]
+  flags, bytes, _, content, err := self.storage.Delete(key)
+  if err != nil {
+    return KeyNotFound, nil
+  }
+  self.cas[key] = 0, false
+  return Ok, newStorageEntry(exptime, flags, bytes, cas_unique, content)
+}
+
+func (self *StorageAdapter) Incr(key string, value uint64, incr bool) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  if previous == nil {
+    return KeyNotFound, nil, nil
+  }
+  if _, err := self.storage.Incr(key, value, incr); err != nil {
+    return IllegalParameter, nil, nil
+  }
+  return Ok, previous, self.stored(key)
+}
+
+/* legacy storages can't change an expiration alone, store the item again */
+func (self *StorageAdapter) Touch(key string, exptime uint32) (ErrorCode, *StorageEntry, *StorageEntry) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  previous := self.current(key)
+  if previous == nil {
+    return KeyNotFound, nil, nil
+  }
+  self.storage.Set(key, previous.flags, exptime, previous.bytes, previous.content)
+  return Ok, previous, self.stored(key)
+}
+
+func (self *StorageAdapter) Flush() {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if storage, ok := self.storage.(flushableStorage); ok {
+    storage.Flush()
+    self.cas = make(map[string]uint64)
+  } else {
+    logger.Println("Storage does not support flushing")
+  }
+}
+
+func (self *StorageAdapter) Walk(f func(key string, entry *StorageEntry)) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if storage, ok := self.storage.(walkableStorage); ok {
+    storage.Walk(func(key string, entry *StorageEntry) {
+      entry.cas_unique = self.cas[key]
+      f(key, entry)
+    })
+  } else {
+    logger.Println("Storage does not support walking its entries")
+  }
+}
+
+func (self *StorageAdapter) Expire(key string) {
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  if storage, ok := self.storage.(expirableStorage); ok && storage.MaybeExpire(key, uint32(time.Seconds())) {
+    self.cas[key] = 0, false
+  }
+}
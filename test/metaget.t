@@ -0,0 +1,45 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 14;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_memcached();
+my $sock = $server->sock;
+
+print $sock "mn\r\n";
+is(scalar <$sock>, "MN\r\n", "noop");
+
+print $sock "ms foo 2 T0 F5\r\nhi\r\n";
+is(scalar <$sock>, "HD\r\n", "stored foo");
+
+print $sock "mg foo s v f t\r\n";
+is(scalar <$sock>, "VA 2 s2 f5 t-1\r\n", "value header");
+is(scalar <$sock>, "hi\r\n", "value");
+
+print $sock "mg foo k O123 h\r\n";
+is(scalar <$sock>, "HD kfoo O123 h1\r\n", "key, opaque and hit before");
+
+print $sock "mg bogus v q\r\nmn\r\n";
+is(scalar <$sock>, "MN\r\n", "quiet miss");
+
+print $sock "ms Zm9v 3 b MA\r\nbar\r\n";
+is(scalar <$sock>, "HD\r\n", "appended with a base64 key");
+mem_get_is($sock, "foo", "hibar");
+
+# stale while revalidate
+print $sock "md foo I T30\r\n";
+is(scalar <$sock>, "HD\r\n", "invalidated foo");
+print $sock "mg foo s\r\n";
+is(scalar <$sock>, "HD s5 W X\r\n", "first client wins the recache");
+print $sock "mg foo s\r\n";
+is(scalar <$sock>, "HD s5 X Z\r\n", "later clients see the win token taken");
+
+print $sock "ma cnt N0 J10 v\r\n";
+is(scalar <$sock>, "VA 2\r\n", "vivified counter");
+is(scalar <$sock>, "10\r\n", "initial value");
+
+print $sock "md cnt q\r\nmn\r\n";
+is(scalar <$sock>, "MN\r\n", "quiet delete");
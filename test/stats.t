@@ -0,0 +1,34 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 16;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_memcached();
+my $sock = $server->sock;
+
+my $stats = mem_stats($sock);
+ok($stats->{pid} > 0, "pid reported");
+ok(defined $stats->{uptime}, "uptime reported");
+ok(defined $stats->{version}, "version reported");
+is($stats->{curr_items}, 0, "no items");
+is($stats->{cmd_get}, 0, "no gets");
+
+print $sock "set foo 0 0 6\r\nfooval\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored foo");
+mem_get_is($sock, "foo", "fooval");
+mem_get_is($sock, "bar", undef);
+
+print $sock "delete bar\r\n";
+is(scalar <$sock>, "NOT_FOUND\r\n", "bar not found");
+
+$stats = mem_stats($sock);
+is($stats->{cmd_set}, 1, "one set");
+is($stats->{cmd_get}, 2, "two gets");
+is($stats->{get_hits}, 1, "one hit");
+is($stats->{get_misses}, 1, "one miss");
+is($stats->{delete_misses}, 1, "one delete miss");
+is($stats->{curr_items}, 1, "one item");
+is($stats->{bytes}, 6, "six bytes");
@@ -0,0 +1,34 @@
+#!/usr/bin/perl
+
+use strict;
+use Test::More tests => 9;
+use FindBin qw($Bin);
+use lib "$Bin/lib";
+use MemcachedTest;
+
+my $server = new_memcached();
+my $sock = $server->sock;
+
+# set foo (and should get it)
+print $sock "set foo 0 2 6\r\nfooval\r\n";
+is(scalar <$sock>, "STORED\r\n", "stored foo");
+mem_get_is($sock, "foo", "fooval");
+
+# touch it
+print $sock "touch foo 10\r\n";
+is(scalar <$sock>, "TOUCHED\r\n", "touched foo");
+
+sleep 2.2;
+mem_get_is($sock, "foo", "fooval");
+
+print $sock "touch bogus 10\r\n";
+is(scalar <$sock>, "NOT_FOUND\r\n", "can't touch bogus key");
+
+# get and touch
+print $sock "gat 2 foo bogus\r\n";
+is(scalar <$sock>, "VALUE foo 0 6\r\n", "gat foo");
+is(scalar <$sock>, "fooval\r\n", "gat foo value");
+is(scalar <$sock>, "END\r\n", "gat end");
+
+sleep 2.2;
+mem_get_is($sock, "foo", undef);
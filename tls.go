@@ -0,0 +1,181 @@
+package main
+
+import (
+  "os"
+  "net"
+  "sync"
+  "time"
+  "strings"
+  "io/ioutil"
+  "crypto/tls"
+  "crypto/x509"
+)
+
+/* TLS listeners are given with -tls-listen, in the -listen syntax. The
+   certificate and key are loaded from -tls-cert and -tls-key, with
+   -tls-client-ca clients must present a certificate signed by one of the
+   authorities in that file. Every file is read again on SIGHUP, sessions
+   already established keep the configuration they were accepted with */
+
+/* clients get this long to complete the handshake */
+const tlsHandshakeTimeout = 10e9
+
+/* the suites -tls-ciphers may name, RC4 is left out as it is broken */
+var cipherSuites = map[string]uint16{
+  "TLS_RSA_WITH_AES_128_CBC_SHA":       tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+  "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA": tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+}
+
+/* used unless -tls-ciphers says otherwise, the package defaults include RC4 */
+var defaultCipherSuites = []uint16{
+  tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+}
+
+/* the cipher suites of a comma separated list of names, the default ones
+   for an empty list */
+func parseCipherSuites(names string) ([]uint16, os.Error) {
+  var suites []uint16
+  for _, name := range strings.Split(names, ",") {
+    if name = strings.TrimSpace(name); name == "" {
+      continue
+    } else if suite, present := cipherSuites[name]; present {
+      suites = append(suites, suite)
+    } else {
+      return nil, os.NewError("Unknown cipher suite " + name)
+    }
+  }
+  if suites == nil {
+    return defaultCipherSuites, nil
+  }
+  return suites, nil
+}
+
+type TLSSettings struct {
+  certFile     string
+  keyFile      string
+  clientCAFile string
+  ciphers      []uint16
+  lock         sync.RWMutex
+  config       *tls.Config
+  clientCAs    *tls.CASet // nil unless client certificates are required
+}
+
+/* set when serving TLS, nil otherwise */
+var tlsSettings *TLSSettings
+
+func newTLSSettings(certFile string, keyFile string, clientCAFile string, ciphers string) (*TLSSettings, os.Error) {
+  suites, err := parseCipherSuites(ciphers)
+  if err != nil {
+    return nil, err
+  }
+  self := &TLSSettings{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile, ciphers: suites}
+  if err = self.Reload(); err != nil {
+    return nil, err
+  }
+  return self, nil
+}
+
+/* read the certificates again, used by connections accepted from now on */
+func (self *TLSSettings) Reload() os.Error {
+  certificate, err := tls.LoadX509KeyPair(self.certFile, self.keyFile)
+  if err != nil {
+    return err
+  }
+  config := &tls.Config{Certificates: []tls.Certificate{certificate}, CipherSuites: self.ciphers}
+  var clientCAs *tls.CASet
+  if self.clientCAFile != "" {
+    pem, err := ioutil.ReadFile(self.clientCAFile)
+    if err != nil {
+      return err
+    }
+    clientCAs = tls.NewCASet()
+    if !clientCAs.SetFromPEM(pem) {
+      return os.NewError("No certificate in " + self.clientCAFile)
+    }
+    config.AuthenticateClient = true
+  }
+  self.lock.Lock()
+  defer self.lock.Unlock()
+  self.config, self.clientCAs = config, clientCAs
+  return nil
+}
+
+func (self *TLSSettings) reloadOrLog() {
+  if err := self.Reload(); err != nil {
+    logger.Printf("Unable to reload the TLS certificates, keeping the previous ones: %s", err)
+  } else {
+    logger.Println("Reloaded the TLS certificates")
+  }
+}
+
+func (self *TLSSettings) current() (*tls.Config, *tls.CASet) {
+  self.lock.RLock()
+  defer self.lock.RUnlock()
+  return self.config, self.clientCAs
+}
+
+/* a listener whose connections are served through TLS */
+type tlsListener struct {
+  net.Listener
+  settings *TLSSettings
+}
+
+func (self *tlsListener) Accept() (net.Conn, os.Error) {
+  conn, err := self.Listener.Accept()
+  if err != nil {
+    return nil, err
+  }
+  config, clientCAs := self.settings.current()
+  return &tlsConn{tls.Server(conn, config), clientCAs}, nil
+}
+
+/* the socket of the listener, to pass it on upgrades */
+func (self *tlsListener) File() (*os.File, os.Error) {
+  if withFile, ok := self.Listener.(fileListener); ok {
+    return withFile.File()
+  }
+  return nil, os.NewError("Listener can't be passed on: " + self.Addr().String())
+}
+
+type tlsConn struct {
+  *tls.Conn
+  clientCAs *tls.CASet
+}
+
+/* run the handshake, checking the client certificate when one is required.
+   Done by the session so a slow client doesn't hold the accept loop, and
+   given tlsHandshakeTimeout so it doesn't hold a connection either */
+func (self *tlsConn) handshake() os.Error {
+  self.Conn.SetTimeout(tlsHandshakeTimeout)
+  if err := self.Conn.Handshake(); err != nil {
+    return err
+  }
+  self.Conn.SetTimeout(0)
+  if self.clientCAs != nil {
+    return verifyChain(self.Conn.PeerCertificates(), self.clientCAs)
+  }
+  return nil
+}
+
+/* check chain, leaf first, is current and leads to one of the authorities */
+func verifyChain(chain []*x509.Certificate, authorities *tls.CASet) os.Error {
+  if len(chain) == 0 {
+    return os.NewError("No client certificate")
+  }
+  now := time.Seconds()
+  for i, certificate := range chain {
+    if now < certificate.NotBefore.Seconds() || now > certificate.NotAfter.Seconds() {
+      return os.NewError("Client certificate expired or not yet valid")
+    }
+    if authorities.FindVerifiedParent(certificate) != nil {
+      return nil
+    }
+    if i + 1 < len(chain) {
+      if err := certificate.CheckSignatureFrom(chain[i + 1]); err != nil {
+        return err
+      }
+    }
+  }
+  return os.NewError("Client certificate not signed by a trusted authority")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+  "time"
+  "bytes"
+  "testing"
+  "crypto/rsa"
+  "crypto/tls"
+  "crypto/rand"
+  "crypto/x509"
+  "encoding/pem"
+)
+
+func TestParseCipherSuites(t *testing.T) {
+
+  suites, err := parseCipherSuites("TLS_RSA_WITH_AES_128_CBC_SHA, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA")
+  assertEquals(t, err == nil, true, "known suites rejected")
+  assertEquals(t, len(suites), 2, "wrong number of suites")
+  assertEquals(t, suites[0], tls.TLS_RSA_WITH_AES_128_CBC_SHA, "wrong suite")
+
+  suites, err = parseCipherSuites("")
+  assertEquals(t, err == nil && len(suites) == len(defaultCipherSuites), true, "empty list should use the defaults")
+
+  _, err = parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+  assertEquals(t, err != nil, true, "RC4 accepted")
+
+  _, err = parseCipherSuites("TLS_NULL")
+  assertEquals(t, err != nil, true, "unknown suite accepted")
+}
+
+func TestVerifyChainRequiresCertificate(t *testing.T) {
+
+  err := verifyChain(nil, tls.NewCASet())
+  assertEquals(t, err != nil, true, "missing client certificate accepted")
+}
+
+/* a certificate for name valid from notBefore to notAfter seconds, signed by
+   parent or self-signed when parent is nil */
+func testCertificate(t *testing.T, name string, notBefore int64, notAfter int64, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+  key, err := rsa.GenerateKey(rand.Reader, 512)
+  if err != nil {
+    t.Fatal(err)
+  }
+  template := &x509.Certificate{
+    SerialNumber:          []byte{1},
+    Subject:               x509.Name{CommonName: name, Organization: []string{name}},
+    NotBefore:             time.SecondsToUTC(notBefore),
+    NotAfter:              time.SecondsToUTC(notAfter),
+    BasicConstraintsValid: true,
+    IsCA:                  parent == nil,
+    KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+  }
+  if parent == nil {
+    parent, parentKey = template, key
+  }
+  der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+  certificate, err := x509.ParseCertificate(der)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return certificate, key
+}
+
+func trusting(certificate *x509.Certificate) *tls.CASet {
+  var encoded bytes.Buffer
+  pem.Encode(&encoded, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+  authorities := tls.NewCASet()
+  authorities.SetFromPEM(encoded.Bytes())
+  return authorities
+}
+
+func TestVerifyChain(t *testing.T) {
+
+  now := time.Seconds()
+  ca, caKey := testCertificate(t, "gocached test CA", now - 3600, now + 3600, nil, nil)
+  authorities := trusting(ca)
+
+  leaf, _ := testCertificate(t, "client", now - 3600, now + 3600, ca, caKey)
+  assertEquals(t, verifyChain([]*x509.Certificate{leaf}, authorities), nil, "trusted client rejected")
+  assertEquals(t, verifyChain([]*x509.Certificate{leaf, ca}, authorities), nil, "trusted chain rejected")
+
+  selfSigned, _ := testCertificate(t, "impostor", now - 3600, now + 3600, nil, nil)
+  assertEquals(t, verifyChain([]*x509.Certificate{selfSigned}, authorities) != nil, true, "self-signed client accepted")
+
+  expired, _ := testCertificate(t, "expired", now - 7200, now - 3600, ca, caKey)
+  assertEquals(t, verifyChain([]*x509.Certificate{expired}, authorities) != nil, true, "expired client accepted")
+}
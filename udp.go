@@ -0,0 +1,136 @@
+package main
+
+import (
+  "os"
+  "net"
+  "bufio"
+  "bytes"
+  "strings"
+  "encoding/binary"
+)
+
+/* memcached UDP protocol. Every datagram starts with an 8 byte frame header
+
+   request id       2 bytes, echoed in the response
+   sequence number  2 bytes, of the datagram within its message
+   datagram count   2 bytes, in the message
+   reserved         2 bytes
+
+   Requests must fit a single datagram, each one is run as a session of its
+   own through the usual loops by a fixed number of workers, datagrams
+   arriving while they are all busy wait in the socket buffer or are dropped.
+   The reply is split across as many datagrams as it takes. UDP is served
+   on the hosts of -listen, at -udp-port */
+
+const (
+  udpHeaderLength = 8
+  udpMaxDatagram  = 1400 // header included, fits the usual MTU
+  udpMaxRequest   = 65536
+  udpWorkers      = 16
+)
+
+/* the addresses to serve UDP on, port on the host of every tcp address in
+   the -listen list */
+func udpAddresses(listen string, port string) []string {
+  var addrs []string
+  for _, addr := range strings.Split(listen, ",") {
+    if addr = strings.TrimSpace(addr); addr == "" {
+      continue
+    }
+    if network, address := listenAddress(addr, port); network == "tcp" {
+      host, _, _ := net.SplitHostPort(address)
+      addrs = append(addrs, net.JoinHostPort(host, port))
+    }
+  }
+  return addrs
+}
+
+type udpRequest struct {
+  from     net.Addr
+  datagram []byte
+}
+
+/* serve requests arriving on addr until the server stops accepting */
+func serveUDP(addr string, store CacheStorage) {
+  var conn net.PacketConn
+  var err os.Error
+  retryWhileUpgrading(func() os.Error {
+    conn, err = net.ListenPacket("udp", addr)
+    return err
+  })
+  if err != nil {
+    logger.Fatalf("Unable to listen on udp %s: %s", addr, err)
+  }
+  logger.Printf("Listening on udp %s", addr)
+  connections.listen(conn)
+  requests := make(chan udpRequest)
+  defer close(requests)
+  for i := 0; i < udpWorkers; i++ {
+    go func() {
+      for request := range requests {
+        udpHandler(conn, request.from, request.datagram, store)
+      }
+    }()
+  }
+  buf := make([]byte, udpMaxRequest)
+  for !connections.isDraining() {
+    n, from, err := conn.ReadFrom(buf)
+    if err != nil {
+      if !connections.isDraining() {
+        logger.Println("An error ocurred reading a udp request")
+      }
+      continue
+    }
+    datagram := make([]byte, n)
+    copy(datagram, buf[:n])
+    requests <- udpRequest{from, datagram}
+  }
+}
+
+func udpHandler(conn net.PacketConn, from net.Addr, datagram []byte, store CacheStorage) {
+  if len(datagram) < udpHeaderLength {
+    return
+  }
+  requestId := binary.BigEndian.Uint16(datagram[0:2])
+  if binary.BigEndian.Uint16(datagram[4:6]) != 1 {
+    // memcached doesn't take requests spanning several datagrams either
+    return
+  }
+  var reply bytes.Buffer
+  payload := bytes.NewBuffer(datagram[udpHeaderLength:])
+  session := &Session{bufreader: bufio.NewReader(payload), writer: &reply, storage: store}
+  session.serve()
+  sendUDPReply(conn, from, requestId, reply.Bytes())
+}
+
+/* send reply as a message of as many datagrams as needed */
+func sendUDPReply(conn net.PacketConn, to net.Addr, requestId uint16, reply []byte) {
+  for _, datagram := range udpDatagrams(requestId, reply) {
+    if _, err := conn.WriteTo(datagram, to); err != nil {
+      return
+    }
+  }
+}
+
+/* split reply into framed datagrams, replies too large to be numbered
+   are replaced by an error */
+func udpDatagrams(requestId uint16, reply []byte) [][]byte {
+  const chunk = udpMaxDatagram - udpHeaderLength
+  if len(reply) > 0xffff * chunk {
+    reply = []byte("SERVER_ERROR reply too large for udp\r\n")
+  }
+  count := (len(reply) + chunk - 1) / chunk
+  datagrams := make([][]byte, count)
+  for i := range datagrams {
+    end := (i + 1) * chunk
+    if end > len(reply) {
+      end = len(reply)
+    }
+    datagram := make([]byte, udpHeaderLength, udpHeaderLength + end - i * chunk)
+    binary.BigEndian.PutUint16(datagram[0:2], requestId)
+    binary.BigEndian.PutUint16(datagram[2:4], uint16(i))
+    binary.BigEndian.PutUint16(datagram[4:6], uint16(count))
+    datagrams[i] = append(datagram, reply[i * chunk:end]...)
+  }
+  return datagrams
+}
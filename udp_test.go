@@ -0,0 +1,82 @@
+package main
+
+import (
+  "os"
+  "net"
+  "bytes"
+  "testing"
+  "encoding/binary"
+)
+
+/* a packet connection keeping the datagrams written to it */
+type recordingPacketConn struct {
+  sent [][]byte
+}
+
+func (self *recordingPacketConn) ReadFrom(b []byte) (int, net.Addr, os.Error) { return 0, nil, os.EOF }
+func (self *recordingPacketConn) WriteTo(b []byte, addr net.Addr) (int, os.Error) {
+  self.sent = append(self.sent, append([]byte(nil), b...))
+  return len(b), nil
+}
+func (self *recordingPacketConn) Close() os.Error                    { return nil }
+func (self *recordingPacketConn) LocalAddr() net.Addr                { return nil }
+func (self *recordingPacketConn) SetTimeout(ns int64) os.Error      { return nil }
+func (self *recordingPacketConn) SetReadTimeout(ns int64) os.Error  { return nil }
+func (self *recordingPacketConn) SetWriteTimeout(ns int64) os.Error { return nil }
+
+/* a request framed as a single datagram */
+func udpRequestDatagram(requestId uint16, count uint16, request string) []byte {
+  datagram := make([]byte, udpHeaderLength)
+  binary.BigEndian.PutUint16(datagram[0:2], requestId)
+  binary.BigEndian.PutUint16(datagram[4:6], count)
+  return append(datagram, request...)
+}
+
+func TestUDPDatagrams(t *testing.T) {
+
+  reply := bytes.Repeat([]byte("x"), 3000)
+  datagrams := udpDatagrams(7, reply)
+  assertEquals(t, len(datagrams), 3, "wrong number of datagrams")
+
+  var joined []byte
+  for i, datagram := range datagrams {
+    assertEquals(t, len(datagram) <= udpMaxDatagram, true, "datagram too large")
+    assertEquals(t, binary.BigEndian.Uint16(datagram[0:2]), uint16(7), "request id not echoed")
+    assertEquals(t, binary.BigEndian.Uint16(datagram[2:4]), uint16(i), "wrong sequence number")
+    assertEquals(t, binary.BigEndian.Uint16(datagram[4:6]), uint16(3), "wrong datagram count")
+    joined = append(joined, datagram[udpHeaderLength:]...)
+  }
+  assertEquals(t, bytes.Equal(joined, reply), true, "reply not split in order")
+  assertEquals(t, len(udpDatagrams(7, nil)), 0, "datagram sent for an empty reply")
+}
+
+func TestUDPRequestAndReply(t *testing.T) {
+
+  storage := newMapCacheStorage(newMemoryLimit(0), nil)
+  conn := &recordingPacketConn{}
+  udpHandler(conn, nil, udpRequestDatagram(0x1234, 1, "set foo 0 0 3\r\nbar\r\n"), storage)
+  udpHandler(conn, nil, udpRequestDatagram(0x1235, 1, "get foo\r\n"), storage)
+  assertEquals(t, len(conn.sent), 2, "wrong number of replies")
+  if len(conn.sent) != 2 {
+    return
+  }
+  assertEquals(t, string(conn.sent[0][udpHeaderLength:]), "STORED\r\n", "wrong set reply")
+  reply := conn.sent[1]
+  assertEquals(t, binary.BigEndian.Uint16(reply[0:2]), uint16(0x1235), "request id not echoed")
+  assertEquals(t, binary.BigEndian.Uint16(reply[2:4]), uint16(0), "wrong sequence number")
+  assertEquals(t, binary.BigEndian.Uint16(reply[4:6]), uint16(1), "wrong datagram count")
+  assertEquals(t, string(reply[udpHeaderLength:]), "VALUE foo 0 3\r\nbar\r\nEND\r\n", "wrong get reply")
+
+  udpHandler(conn, nil, udpRequestDatagram(0x1236, 2, "get foo\r\n"), storage)
+  udpHandler(conn, nil, []byte{0x12, 0x37}, storage)
+  assertEquals(t, len(conn.sent), 2, "replied to a split or truncated request")
+}
+
+func TestUDPAddresses(t *testing.T) {
+
+  addrs := udpAddresses("10.0.0.1:11211, [::1], unix:/tmp/gocached.sock", "11213")
+  assertEquals(t, len(addrs), 2, "wrong number of udp addresses")
+  assertEquals(t, addrs[0], "10.0.0.1:11213", "wrong IPv4 address")
+  assertEquals(t, addrs[1], "[::1]:11213", "wrong IPv6 address")
+  assertEquals(t, len(udpAddresses("unix:/tmp/gocached.sock", "11213")), 0, "udp served on a unix socket")
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+  "os"
+  "io"
+  "fmt"
+  "net"
+  "exec"
+  "bufio"
+  "bytes"
+  "strings"
+  "strconv"
+  "time"
+  "path/filepath"
+  "sync/atomic"
+  "encoding/binary"
+)
+
+/* Binary upgrades. On SIGUSR1 the running process starts the executable it
+   was launched from, passing its listening sockets as file descriptors 3 and
+   up, in place of -listen and -tls-listen, and the path of a unix socket in
+   the environment. The new process connects to it, optionally receives the
+   cache contents as a snapshot, starts accepting on the inherited socket and
+   replies READY. Only then does the old process stop accepting and drain its
+   connections. From the moment it hands over the persistence files the old
+   process refuses writes, as a read only replica does, so none is lost
+   between the copy and the new process serving. Writes come back should the
+   upgrade fail.
+
+   Before sending anything the old process syncs and closes its journal and
+   stops saving snapshots, the new one only opens the persistence files once
+   it has been sent the contents. Should the upgrade fail the old process
+   opens them again and checkpoints. Other listening ports are retried by the new
+   process until the old one has released them. Unix domain sockets are
+   not closed by the old process, as that would remove the socket file, a
+   connection it accepts while draining is dropped */
+
+const (
+  upgradeFdEnv     = "GOCACHED_UPGRADE_FD"
+  upgradeSocketEnv = "GOCACHED_UPGRADE_SOCKET"
+  upgradeTimeout   = 60e9
+)
+
+/* the executable to start on upgrades, resolved at startup so a binary
+   replaced on disk is picked up */
+var executable string
+
+/* whether this process was started by an upgrade */
+var upgraded = os.Getenv(upgradeSocketEnv) != ""
+
+/* set once a new process has taken over */
+var handedOff bool
+
+/* set while the persistence files are handed over, writes are refused */
+var handingOver int32
+
+func handingOff() bool {
+  return atomic.LoadInt32(&handingOver) == 1
+}
+
+/* functions stopping the use of the persistence files while they are handed
+   over, and the ones resuming it when the upgrade fails */
+var pauseHooks, resumeHooks []func()
+
+func onHandOff(pause func(), resume func()) {
+  pauseHooks = append(pauseHooks, pause)
+  resumeHooks = append(resumeHooks, resume)
+}
+
+func resolveExecutable() {
+  var err os.Error
+  if strings.Contains(os.Args[0], "/") {
+    executable, err = filepath.Abs(os.Args[0])
+  } else {
+    executable, err = exec.LookPath(os.Args[0])
+  }
+  if err != nil {
+    logger.Printf("Unable to resolve the executable, upgrades disabled: %s", err)
+  }
+}
+
+/* the listeners passed by the process being upgraded, nil if there are none */
+func inheritedListeners() ([]net.Listener, os.Error) {
+  fds := os.Getenv(upgradeFdEnv)
+  if fds == "" {
+    return nil, nil
+  }
+  var listeners []net.Listener
+  for _, field := range strings.Split(fds, ",") {
+    // tls listeners are passed as tls:fd
+    secure := strings.HasPrefix(field, "tls:")
+    if secure {
+      field = field[len("tls:"):]
+    }
+    fd, err := strconv.Atoi(field)
+    if err != nil {
+      return nil, os.NewError("Invalid inherited file descriptor " + field)
+    }
+    listener, err := net.FileListener(os.NewFile(fd, "listener"))
+    if err != nil {
+      return nil, err
+    }
+    if secure {
+      if tlsSettings == nil {
+        return nil, os.NewError("Inherited a TLS listener without a TLS configuration")
+      }
+      listener = &tlsListener{listener, tlsSettings}
+    }
+    listeners = append(listeners, listener)
+  }
+  logger.Printf("Serving on %d listeners inherited from the previous process", len(listeners))
+  return listeners, nil
+}
+
+/* the listening sockets of this process, to pass to the new one */
+type fileListener interface {
+  File() (*os.File, os.Error)
+}
+
+/* the connection to the process being upgraded and whether it sent its
+   contents, which are loaded into storage. Once this returns the previous
+   process no longer writes the persistence files */
+func receiveHandoff(storage CacheStorage) (net.Conn, bool, os.Error) {
+  conn, err := net.Dial("unix", os.Getenv(upgradeSocketEnv))
+  if err != nil {
+    return nil, false, err
+  }
+  size := make([]byte, 8)
+  if _, err = io.ReadFull(conn, size); err != nil {
+    conn.Close()
+    return nil, false, err
+  }
+  length := binary.BigEndian.Uint64(size)
+  if length > 0 {
+    data := make([]byte, length)
+    if _, err = io.ReadFull(conn, data); err != nil {
+      conn.Close()
+      return nil, false, err
+    }
+    storage.Flush()
+    count, err := loadSnapshot(data, storage)
+    if err != nil {
+      conn.Close()
+      return nil, false, err
+    }
+    logger.Printf("Received %d items from the previous process", count)
+  }
+  return conn, length > 0, nil
+}
+
+/* tell the previous process this one is serving */
+func signalReady(conn net.Conn) {
+  io.WriteString(conn, "READY\n")
+  conn.Close()
+}
+
+/* the environment for the new process, replacing the variables of a
+   previous upgrade */
+func upgradeEnvironment(socketPath string, fds []string) []string {
+  var env []string
+  for _, variable := range os.Environ() {
+    if !strings.HasPrefix(variable, upgradeFdEnv + "=") && !strings.HasPrefix(variable, upgradeSocketEnv + "=") {
+      env = append(env, variable)
+    }
+  }
+  return append(env, upgradeFdEnv + "=" + strings.Join(fds, ","), upgradeSocketEnv + "=" + socketPath)
+}
+
+/* start a new process on listeners and stop accepting once it is ready.
+   With transferCache the contents of storage are sent to it */
+func upgrade(listeners []net.Listener, storage CacheStorage, transferCache bool) os.Error {
+  if executable == "" {
+    return os.NewError("Unknown executable")
+  }
+  socketPath := fmt.Sprintf("%s/gocached-upgrade-%d.sock", os.TempDir(), os.Getpid())
+  os.Remove(socketPath)
+  handoff, err := net.Listen("unix", socketPath)
+  if err != nil {
+    return err
+  }
+  defer handoff.Close()
+  defer os.Remove(socketPath)
+
+  files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+  var fds []string
+  for _, listener := range listeners {
+    withFile, ok := listener.(fileListener)
+    if !ok {
+      return os.NewError("Listener can't be passed on: " + listener.Addr().String())
+    }
+    file, err := withFile.File()
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    if _, secure := listener.(*tlsListener); secure {
+      fds = append(fds, "tls:" + strconv.Itoa(len(files)))
+    } else {
+      fds = append(fds, strconv.Itoa(len(files)))
+    }
+    files = append(files, file)
+  }
+  attr := &os.ProcAttr{Env: upgradeEnvironment(socketPath, fds), Files: files}
+  process, err := os.StartProcess(executable, os.Args, attr)
+  if err != nil {
+    return err
+  }
+  logger.Printf("Started %s as process %d", executable, process.Pid)
+
+  if err = handOver(handoff, storage, transferCache); err != nil {
+    process.Kill()
+    return err
+  }
+  handedOff = true
+  connections.stopAccepting()
+  return nil
+}
+
+/* wait for the new process, send it the contents and wait until it serves */
+func handOver(handoff net.Listener, storage CacheStorage, transferCache bool) (err os.Error) {
+  accepted := make(chan net.Conn, 1)
+  go func() {
+    if conn, err := handoff.Accept(); err == nil {
+      accepted <- conn
+    }
+    close(accepted)
+  }()
+  var conn net.Conn
+  select {
+  case conn = <-accepted:
+  case <-time.After(upgradeTimeout):
+  }
+  if conn == nil {
+    return os.NewError("New process didn't connect")
+  }
+  defer conn.Close()
+  conn.SetTimeout(upgradeTimeout)
+
+  atomic.StoreInt32(&handingOver, 1)
+  for _, pause := range pauseHooks {
+    pause()
+  }
+  defer func() {
+    if err != nil {
+      for _, resume := range resumeHooks {
+        resume()
+      }
+      atomic.StoreInt32(&handingOver, 0)
+    }
+  }()
+
+  var contents bytes.Buffer
+  if transferCache {
+    count, err := writeSnapshot(&contents, storage, 0)
+    if err != nil {
+      return err
+    }
+    logger.Printf("Sending %d items to the new process", count)
+  }
+  size := make([]byte, 8)
+  binary.BigEndian.PutUint64(size, uint64(contents.Len()))
+  if _, err := conn.Write(size); err != nil {
+    return err
+  } else if _, err := conn.Write(contents.Bytes()); err != nil {
+    return err
+  }
+  if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "READY\n" {
+    return os.NewError("New process didn't get ready")
+  }
+  logger.Println("New process is serving, draining connections")
+  return nil
+}
+
+/* listen on addr, retrying while a process being upgraded still holds it */
+func listenRetrying(network string, addr string) (listener net.Listener, err os.Error) {
+  retryWhileUpgrading(func() os.Error {
+    listener, err = net.Listen(network, addr)
+    return err
+  })
+  return listener, err
+}
+
+/* run bind until it succeeds or the process being upgraded had time enough
+   to release what it binds */
+func retryWhileUpgrading(bind func() os.Error) {
+  for attempt := int64(0); ; attempt++ {
+    if err := bind(); err == nil || !upgraded || attempt * 1e9 >= upgradeTimeout {
+      return
+    }
+    time.Sleep(1e9)
+  }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "os"
+  "fmt"
+  "net"
+  "bytes"
+  "strings"
+  "strconv"
+  "testing"
+  "sync/atomic"
+)
+
+func TestUpgradeEnvironmentReplacesAPreviousUpgrade(t *testing.T) {
+
+  os.Setenv(upgradeFdEnv, "5")
+  os.Setenv(upgradeSocketEnv, "/tmp/previous.sock")
+  defer os.Setenv(upgradeFdEnv, "")
+  defer os.Setenv(upgradeSocketEnv, "")
+
+  var fds, sockets []string
+  for _, variable := range upgradeEnvironment("/tmp/next.sock", []string{"3", "tls:4"}) {
+    if strings.HasPrefix(variable, upgradeFdEnv + "=") {
+      fds = append(fds, variable)
+    } else if strings.HasPrefix(variable, upgradeSocketEnv + "=") {
+      sockets = append(sockets, variable)
+    }
+  }
+  assertEquals(t, len(fds), 1, "descriptors passed more than once")
+  assertEquals(t, fds[0], upgradeFdEnv + "=3,tls:4", "wrong descriptors")
+  assertEquals(t, len(sockets), 1, "socket passed more than once")
+  assertEquals(t, sockets[0], upgradeSocketEnv + "=/tmp/next.sock", "wrong socket")
+}
+
+func TestInheritedListeners(t *testing.T) {
+
+  listeners, err := inheritedListeners()
+  assertEquals(t, err == nil && listeners == nil, true, "listeners inherited without an upgrade")
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer listener.Close()
+  file, err := listener.(fileListener).File()
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  defer os.Setenv(upgradeFdEnv, "")
+
+  os.Setenv(upgradeFdEnv, strconv.Itoa(file.Fd()))
+  listeners, err = inheritedListeners()
+  assertEquals(t, err == nil && len(listeners) == 1, true, "listener not inherited")
+  if len(listeners) == 1 {
+    assertEquals(t, listeners[0].Addr().String(), listener.Addr().String(), "wrong listener inherited")
+    listeners[0].Close()
+  }
+
+  os.Setenv(upgradeFdEnv, "tls:" + strconv.Itoa(file.Fd()))
+  _, err = inheritedListeners()
+  assertEquals(t, err != nil, true, "TLS listener inherited without a TLS configuration")
+
+  os.Setenv(upgradeFdEnv, "three")
+  _, err = inheritedListeners()
+  assertEquals(t, err != nil, true, "invalid descriptor accepted")
+}
+
+/* a handoff socket, with the environment pointing the new process at it */
+func listenHandoff(t *testing.T) (net.Listener, string) {
+  path := fmt.Sprintf("%s/gocached-test-%d.sock", os.TempDir(), os.Getpid())
+  os.Remove(path)
+  handoff, err := net.Listen("unix", path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  os.Setenv(upgradeSocketEnv, path)
+  return handoff, path
+}
+
+func TestHandOverSendsTheContentsAndRefusesWrites(t *testing.T) {
+
+  handoff, path := listenHandoff(t)
+  defer os.Remove(path)
+  defer handoff.Close()
+  defer os.Setenv(upgradeSocketEnv, "")
+  defer atomic.StoreInt32(&handingOver, 0)
+
+  source := newMapCacheStorage(newMemoryLimit(0), nil)
+  source.Set("foo", 0, 0, 3, []byte("bar"))
+  done := make(chan os.Error)
+  go func() { done <- handOver(handoff, source, true) }()
+
+  target := newMapCacheStorage(newMemoryLimit(0), nil)
+  conn, transferred, err := receiveHandoff(target)
+  if err != nil {
+    t.Fatal(err)
+  }
+  assertEquals(t, transferred, true, "contents not transferred")
+  _, entry := target.Get("foo")
+  assertEquals(t, entry != nil && string(entry.content) == "bar", true, "item not transferred")
+
+  client := &recordingConn{input: bytes.NewBufferString("delete foo\r\nget foo\r\n")}
+  session, _ := NewSession(client, source)
+  session.serve()
+  assertEquals(t, client.output.String(), "SERVER_ERROR upgrading\r\nVALUE foo 0 3\r\nbar\r\nEND\r\n", "write served while handing over")
+
+  signalReady(conn)
+  assertEquals(t, <-done == nil, true, "handover failed")
+  assertEquals(t, handingOff(), true, "writes accepted after the handover")
+}
+
+func TestFailedHandOverResumes(t *testing.T) {
+
+  handoff, path := listenHandoff(t)
+  defer os.Remove(path)
+  defer handoff.Close()
+  defer os.Setenv(upgradeSocketEnv, "")
+
+  pause, resume := pauseHooks, resumeHooks
+  defer func() { pauseHooks, resumeHooks = pause, resume }()
+  pauseHooks, resumeHooks = nil, nil
+  paused, resumed := 0, 0
+  onHandOff(func() { paused++ }, func() { resumed++ })
+
+  done := make(chan os.Error)
+  go func() { done <- handOver(handoff, newMapCacheStorage(newMemoryLimit(0), nil), false) }()
+
+  conn, transferred, err := receiveHandoff(newMapCacheStorage(newMemoryLimit(0), nil))
+  if err != nil {
+    t.Fatal(err)
+  }
+  assertEquals(t, transferred, false, "contents transferred unasked")
+  conn.Close()
+  assertEquals(t, <-done != nil, true, "handover succeeded without READY")
+  assertEquals(t, paused, 1, "persistence not paused")
+  assertEquals(t, resumed, 1, "persistence not resumed")
+  assertEquals(t, handingOff(), false, "writes still refused")
+}